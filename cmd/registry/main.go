@@ -0,0 +1,40 @@
+package main
+
+import (
+	"Hystrix/common/registry"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+//内置注册中心，用于集成测试和演示，服务使用 -discovery=registry 接入
+func main() {
+	var (
+		addr         = flag.String("addr", ":8700", "registry http listen address")
+		reapInterval = flag.Duration("reap-interval", registry.DefaultReapInterval, "interval to remove instances whose heartbeat expired")
+	)
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	reg := registry.NewRegistry(logger)
+	reg.Start(*reapInterval)
+	defer reg.Stop()
+
+	errChan := make(chan error)
+	go func() {
+		logger.Println("registry start at", *addr)
+		errChan <- http.ListenAndServe(*addr, registry.NewHandler(reg))
+	}()
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errChan <- fmt.Errorf("%s", <-c)
+	}()
+
+	logger.Println(<-errChan)
+}
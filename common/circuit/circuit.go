@@ -0,0 +1,68 @@
+package circuit
+
+import (
+	"Hystrix/common/discover"
+	"github.com/afex/hystrix-go/hystrix"
+	"sync"
+	"time"
+)
+
+//实例级别断路器的hystrix命令名称：<服务级命令名>/<实例ID>
+func InstanceCommandName(commandName, instanceID string) string {
+	return commandName + "/" + instanceID
+}
+
+//按实例维护的断路器，负载均衡前跳过断路器打开的实例
+//hystrix在断路器打开超过SleepWindow后放行一个试探请求，为了让试探请求能到达该实例，
+//断路器打开的实例每个SleepWindow放行一次
+type InstanceBreakers struct {
+	mutex sync.Mutex
+	//断路器打开的实例下一次放行的时间
+	nextTrial map[string]time.Time
+}
+
+func NewInstanceBreakers() *InstanceBreakers {
+	return &InstanceBreakers{
+		nextTrial: make(map[string]time.Time),
+	}
+}
+
+//返回断路器未打开的实例，所有实例的断路器都打开时返回空
+//尚未配置hystrix命令的实例视为可用：在配置前调用hystrix.GetCircuit会按默认参数创建断路器，
+//之后的ConfigureCommand不再改变其并发数
+func (b *InstanceBreakers) Available(commandName string, services []*discover.ServiceInstance) []*discover.ServiceInstance {
+	settings := hystrix.GetCircuitSettings()
+	available := make([]*discover.ServiceInstance, 0, len(services))
+	for _, service := range services {
+		name := InstanceCommandName(commandName, service.ID)
+		if setting, ok := settings[name]; !ok || b.allow(name, setting.SleepWindow) {
+			available = append(available, service)
+		}
+	}
+	return available
+}
+
+func (b *InstanceBreakers) allow(name string, sleepWindow time.Duration) bool {
+	circuit, _, err := hystrix.GetCircuit(name)
+	if err != nil || !circuit.IsOpen() {
+		b.mutex.Lock()
+		delete(b.nextTrial, name)
+		b.mutex.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	next, ok := b.nextTrial[name]
+	if !ok {
+		//第一次发现断路器打开，等待一个SleepWindow后再放行
+		b.nextTrial[name] = now.Add(sleepWindow)
+		return false
+	}
+	if now.Before(next) {
+		return false
+	}
+	b.nextTrial[name] = now.Add(sleepWindow)
+	return true
+}
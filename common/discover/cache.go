@@ -0,0 +1,177 @@
+package discover
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	//缓存超过最大过期时间未刷新
+	ErrCacheStale = errors.New("service instances cache is stale")
+	//服务实例从未成功刷新
+	ErrNotRefreshed = errors.New("service instances not refreshed yet")
+)
+
+//服务实例缓存项，每次刷新时整体替换
+type cacheEntry struct {
+	instances []*ServiceInstance
+	//最近一次成功刷新的时间，从未成功时为零值
+	refreshedAt time.Time
+	//最近一次刷新失败的时间和错误
+	failedAt time.Time
+	err      error
+	//最近一次成功刷新之后第一次失败的时间，刷新成功后清零
+	failingSince time.Time
+}
+
+//按服务名缓存实例列表并记录最近一次成功刷新的时间
+//刷新失败时保留原有的实例列表，maxStaleness大于0时持续失败超过该时间后不再返回
+//阻塞查询和按TTL刷新可能长时间才返回一次，因此从第一次失败而不是最近一次成功开始计算
+type instanceCache struct {
+	backend      string
+	maxStaleness time.Duration
+	entries      sync.Map
+	//串行执行更新，读取不加锁
+	mutex sync.Mutex
+}
+
+func newInstanceCache(backend string, maxStaleness time.Duration) *instanceCache {
+	cache := &instanceCache{
+		backend:      backend,
+		maxStaleness: maxStaleness,
+	}
+	defaultCacheCollector.add(cache)
+	return cache
+}
+
+//从所有缓存指标中移除
+func (cache *instanceCache) close() {
+	defaultCacheCollector.remove(cache)
+}
+
+//返回缓存的实例列表，服务未缓存或从未成功刷新时ok为false
+//持续失败超过最大过期时间时返回ErrCacheStale
+func (cache *instanceCache) get(serviceName string) (instances []*ServiceInstance, ok bool, err error) {
+	value, found := cache.entries.Load(serviceName)
+	if !found {
+		return nil, false, nil
+	}
+	entry := value.(*cacheEntry)
+	if entry.refreshedAt.IsZero() {
+		return nil, false, nil
+	}
+	if cache.maxStaleness > 0 && !entry.failingSince.IsZero() && time.Since(entry.failingSince) > cache.maxStaleness {
+		return nil, true, &Error{Op: OpDiscover, Service: serviceName, Err: ErrCacheStale}
+	}
+	return entry.instances, true, nil
+}
+
+//最近一次刷新失败的时间和错误
+func (cache *instanceCache) lastFailure(serviceName string) (time.Time, error) {
+	if value, ok := cache.entries.Load(serviceName); ok {
+		entry := value.(*cacheEntry)
+		return entry.failedAt, entry.err
+	}
+	return time.Time{}, nil
+}
+
+//刷新成功，实例列表变化时返回true
+func (cache *instanceCache) store(serviceName string, instances []*ServiceInstance) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	old, _ := cache.entries.Load(serviceName)
+	cache.entries.Store(serviceName, &cacheEntry{
+		instances:   instances,
+		refreshedAt: time.Now(),
+	})
+	if old == nil {
+		return true
+	}
+	entry := old.(*cacheEntry)
+	return entry.refreshedAt.IsZero() || !sameInstances(entry.instances, instances)
+}
+
+//刷新失败，保留原有的实例列表
+func (cache *instanceCache) fail(serviceName string, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := &cacheEntry{}
+	if old, ok := cache.entries.Load(serviceName); ok {
+		*entry = *old.(*cacheEntry)
+	}
+	entry.failedAt = time.Now()
+	entry.err = err
+	if entry.failingSince.IsZero() {
+		entry.failingSince = entry.failedAt
+	}
+	cache.entries.Store(serviceName, entry)
+	refreshErrors.WithLabelValues(cache.backend, serviceName).Inc()
+}
+
+var (
+	cacheAgeDesc = prometheus.NewDesc(
+		"discovery_cache_age_seconds",
+		"Seconds since the service instances were last refreshed from the discovery backend (a blocking query returning without changes counts as a refresh), +Inf if never refreshed.",
+		[]string{"backend", "service"}, nil,
+	)
+	refreshErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discovery_refresh_errors_total",
+		Help: "Number of failed service instance refreshes from the discovery backend.",
+	}, []string{"backend", "service"})
+
+	defaultCacheCollector = &cacheCollector{caches: make(map[*instanceCache]struct{})}
+)
+
+func init() {
+	prometheus.MustRegister(defaultCacheCollector, refreshErrors)
+}
+
+//采集时计算所有缓存项的过期时间
+type cacheCollector struct {
+	mutex  sync.Mutex
+	caches map[*instanceCache]struct{}
+}
+
+func (c *cacheCollector) add(cache *instanceCache) {
+	c.mutex.Lock()
+	c.caches[cache] = struct{}{}
+	c.mutex.Unlock()
+}
+
+func (c *cacheCollector) remove(cache *instanceCache) {
+	c.mutex.Lock()
+	delete(c.caches, cache)
+	c.mutex.Unlock()
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheAgeDesc
+}
+
+//同一进程中有多个相同后端的客户端时，同一服务取最大的过期时间
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	ages := make(map[[2]string]float64)
+	for cache := range c.caches {
+		cache.entries.Range(func(key, value interface{}) bool {
+			entry := value.(*cacheEntry)
+			age := math.Inf(1)
+			if !entry.refreshedAt.IsZero() {
+				age = now.Sub(entry.refreshedAt).Seconds()
+			}
+			labels := [2]string{cache.backend, key.(string)}
+			if old, ok := ages[labels]; !ok || age > old {
+				ages[labels] = age
+			}
+			return true
+		})
+	}
+	for labels, age := range ages {
+		ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, age, labels[0], labels[1])
+	}
+}
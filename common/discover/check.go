@@ -0,0 +1,93 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//健康检查类型
+const (
+	//注册中心定时请求实例的HTTP健康检查路径
+	CheckHTTP = "http"
+	//实例在后台定时向注册中心发送心跳，注册中心无需访问实例
+	CheckTTL = "ttl"
+	//注册中心定时建立到实例的TCP连接
+	CheckTCP = "tcp"
+	//注册中心定时调用实例的gRPC健康检查服务（grpc.health.v1.Health）
+	CheckGRPC = "grpc"
+)
+
+//健康检查参数的默认值
+const (
+	DefaultCheckInterval        = 15 * time.Second
+	DefaultCheckTTL             = 30 * time.Second
+	DefaultCheckDeregisterAfter = 30 * time.Second
+)
+
+//服务注册时的健康检查，Registration.Check为nil时使用HealthCheckUrl的HTTP检查
+//consul支持所有类型；内置注册中心始终由客户端发送心跳，file和dns后端忽略健康检查
+type Check struct {
+	//http、ttl、tcp或grpc，为空时为http
+	Type string
+	//http、tcp、grpc检查的间隔，为0时使用DefaultCheckInterval
+	Interval time.Duration
+	//单次检查的超时，为0时使用注册中心的默认值
+	Timeout time.Duration
+	//ttl检查的超时，实例每TTL/3发送一次心跳，为0时使用DefaultCheckTTL
+	TTL time.Duration
+	//检查持续失败多久后注销实例，为0时使用DefaultCheckDeregisterAfter，小于0时不自动注销
+	DeregisterAfter time.Duration
+	//grpc检查的服务名，为空时检查整个服务器
+	GRPCService string
+	//grpc检查是否使用TLS
+	GRPCUseTLS bool
+	//ttl检查心跳上报的健康状态（passing、warning或critical）及说明，为nil时始终为passing
+	Status func(ctx context.Context) (status, output string)
+}
+
+//填充默认值，类型不支持时返回ErrInvalidRegistration
+func (check Check) withDefaults() (Check, error) {
+	if check.Type == "" {
+		check.Type = CheckHTTP
+	}
+	switch check.Type {
+	case CheckHTTP, CheckTCP, CheckGRPC:
+		if check.Interval <= 0 {
+			check.Interval = DefaultCheckInterval
+		}
+	case CheckTTL:
+		if check.TTL <= 0 {
+			check.TTL = DefaultCheckTTL
+		}
+	default:
+		return check, fmt.Errorf("%w: unknown check type %q", ErrInvalidRegistration, check.Type)
+	}
+	if check.DeregisterAfter == 0 {
+		check.DeregisterAfter = DefaultCheckDeregisterAfter
+	}
+	return check, nil
+}
+
+//注册信息中的健康检查，未设置时为HealthCheckUrl的HTTP检查
+func (registration *Registration) check() (Check, error) {
+	if registration.Check == nil {
+		return Check{}.withDefaults()
+	}
+	return registration.Check.withDefaults()
+}
+
+//心跳请求的ctx，超时或stopCs中任一通道关闭（例如Deregister）时取消，使注销后不再等待进行中的心跳
+func heartbeatContext(parent context.Context, timeout time.Duration, stopCs ...<-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	for _, stopC := range stopCs {
+		go func(stopC <-chan struct{}) {
+			select {
+			case <-stopC:
+				cancel()
+			case <-ctx.Done():
+			}
+		}(stopC)
+	}
+	return ctx, cancel
+}
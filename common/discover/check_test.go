@@ -0,0 +1,67 @@
+package discover
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegistrationCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		check *Check
+		want  Check
+	}{
+		{"default http check", nil, Check{Type: CheckHTTP, Interval: DefaultCheckInterval, DeregisterAfter: DefaultCheckDeregisterAfter}},
+		{"ttl", &Check{Type: CheckTTL}, Check{Type: CheckTTL, TTL: DefaultCheckTTL, DeregisterAfter: DefaultCheckDeregisterAfter}},
+		{"tcp with timings", &Check{Type: CheckTCP, Interval: time.Second, Timeout: 500 * time.Millisecond, DeregisterAfter: -1},
+			Check{Type: CheckTCP, Interval: time.Second, Timeout: 500 * time.Millisecond, DeregisterAfter: -1}},
+		{"grpc", &Check{Type: CheckGRPC, GRPCService: "string"}, Check{Type: CheckGRPC, Interval: DefaultCheckInterval, DeregisterAfter: DefaultCheckDeregisterAfter, GRPCService: "string"}},
+	}
+	for _, test := range tests {
+		registration := &Registration{ServiceName: "string", InstanceID: "string-1", Check: test.check}
+		got, err := registration.check()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got.Type != test.want.Type || got.Interval != test.want.Interval || got.Timeout != test.want.Timeout ||
+			got.TTL != test.want.TTL || got.DeregisterAfter != test.want.DeregisterAfter || got.GRPCService != test.want.GRPCService {
+			t.Errorf("%s: check %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	registration := &Registration{ServiceName: "string", InstanceID: "string-1", Check: &Check{Type: "script"}}
+	if _, err := registration.check(); !errors.Is(err, ErrInvalidRegistration) {
+		t.Errorf("unknown check type returned %v, want ErrInvalidRegistration", err)
+	}
+}
+
+func TestConsulCheck(t *testing.T) {
+	registration := &Registration{ServiceName: "string", InstanceID: "string-1", Host: "10.0.0.1", Port: 8000, HealthCheckUrl: "/health/ready"}
+	tests := []struct {
+		name  string
+		check Check
+		//期望的检查地址、间隔、TTL、自动注销时间
+		target, interval, ttl, deregister string
+		grpcTLS                           bool
+	}{
+		{"http", Check{Type: CheckHTTP}, "http://10.0.0.1:8000/health/ready", "15s", "", "30s", false},
+		{"tcp", Check{Type: CheckTCP, Interval: 5 * time.Second}, "10.0.0.1:8000", "5s", "", "30s", false},
+		{"grpc service with tls", Check{Type: CheckGRPC, GRPCService: "string.v1", GRPCUseTLS: true}, "10.0.0.1:8000/string.v1", "15s", "", "30s", true},
+		{"ttl without interval", Check{Type: CheckTTL, TTL: 9 * time.Second}, "", "", "9s", "30s", false},
+		{"never deregister", Check{Type: CheckTCP, DeregisterAfter: -1}, "10.0.0.1:8000", "15s", "", "", false},
+	}
+	for _, test := range tests {
+		check, err := test.check.withDefaults()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := consulCheck(registration, check)
+		target := got.HTTP + got.TCP + got.GRPC
+		if got.CheckID != "service:string-1" || target != test.target || got.Interval != test.interval || got.TTL != test.ttl ||
+			got.DeregisterCriticalServiceAfter != test.deregister || got.GRPCUseTLS != test.grpcTLS {
+			t.Errorf("%s: consul check %+v", test.name, got)
+		}
+	}
+}
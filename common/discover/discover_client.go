@@ -16,5 +16,16 @@ type DiscoveryClient interface {
 	/**
 	服务发现
 	*/
-	DiscoverServices(serviceName string, logger *log.Logger) []interface{}
+	DiscoverServices(serviceName string, logger *log.Logger) []*ServiceInstance
+
+	Watcher
+}
+
+//订阅服务实例的变化
+type Watcher interface {
+	/**
+	订阅服务的实例变化，通道中首先是当前的实例列表，之后每次实例变化时推送新的列表，
+	订阅者处理较慢时中间的变化会被合并；调用cancel取消订阅并关闭通道
+	*/
+	Watch(serviceName string) (<-chan []*ServiceInstance, func())
 }
@@ -0,0 +1,146 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+//服务注册信息
+type Registration struct {
+	ServiceName string
+	InstanceID  string
+	Host        string
+	Port        int
+	//健康检查路径，例如 /health
+	HealthCheckUrl string
+	Tags           []string
+	Meta           map[string]string
+	//健康检查类型及参数，为nil时使用HealthCheckUrl的HTTP检查
+	Check *Check
+}
+
+//支持context并返回错误的服务注册与发现客户端
+type DiscoveryClientV2 interface {
+	/**
+	服务注册
+	*/
+	Register(ctx context.Context, registration *Registration) error
+
+	/**
+	服务注销
+	*/
+	Deregister(ctx context.Context, instanceID string) error
+
+	/**
+	服务发现
+	*/
+	DiscoverServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error)
+
+	Watcher
+
+	/**
+	停止后台的查询、心跳并关闭所有订阅，不注销已注册的实例
+	*/
+	Close()
+}
+
+//注册中心操作
+const (
+	OpRegister   = "register"
+	OpDeregister = "deregister"
+	OpDiscover   = "discover"
+)
+
+var ErrInvalidRegistration = errors.New("invalid service registration")
+
+//注册中心操作失败，Err为底层错误
+type Error struct {
+	Op         string
+	Service    string
+	InstanceID string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	msg := e.Op
+	if e.Service != "" {
+		msg += " service " + e.Service
+	}
+	if e.InstanceID != "" {
+		msg += " instance " + e.InstanceID
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//注册失败时按backoff重试直到成功或ctx结束，backoff每次翻倍，不超过maxBackoff
+//ctx结束时返回最后一次注册的错误
+func RegisterWithRetry(ctx context.Context, client DiscoveryClientV2, registration *Registration, backoff, maxBackoff time.Duration, logger *log.Logger) error {
+	for {
+		err := client.Register(ctx, registration)
+		if err == nil || errors.Is(err, ErrInvalidRegistration) {
+			return err
+		}
+		logger.Println(err, "retry in", backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//将DiscoveryClientV2适配为DiscoveryClient，供原有调用方使用
+func NewDiscoveryClientAdapter(client DiscoveryClientV2) DiscoveryClient {
+	return &discoveryClientAdapter{client: client}
+}
+
+type discoveryClientAdapter struct {
+	client DiscoveryClientV2
+}
+
+func (adapter *discoveryClientAdapter) Register(serviceName, instanceId, healthCheckUrl string, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+	err := adapter.client.Register(context.Background(), &Registration{
+		ServiceName:    serviceName,
+		InstanceID:     instanceId,
+		Host:           instanceHost,
+		Port:           instancePort,
+		HealthCheckUrl: healthCheckUrl,
+		Meta:           meta,
+	})
+	if err != nil {
+		logger.Println("register service error:", err)
+		return false
+	}
+	logger.Println("register service success")
+	return true
+}
+
+func (adapter *discoveryClientAdapter) Deregister(instanceId string, logger *log.Logger) bool {
+	if err := adapter.client.Deregister(context.Background(), instanceId); err != nil {
+		logger.Println("deregister service error:", err)
+		return false
+	}
+	logger.Println("deregister service success")
+	return true
+}
+
+func (adapter *discoveryClientAdapter) Watch(serviceName string) (<-chan []*ServiceInstance, func()) {
+	return adapter.client.Watch(serviceName)
+}
+
+func (adapter *discoveryClientAdapter) DiscoverServices(serviceName string, logger *log.Logger) []*ServiceInstance {
+	instances, err := adapter.client.DiscoverServices(context.Background(), serviceName)
+	if err != nil {
+		logger.Println("discover service error:", err)
+	}
+	return instances
+}
@@ -0,0 +1,385 @@
+package discover
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//未配置resolver且无法读取/etc/resolv.conf时使用的DNS服务器
+	defaultDNSResolver = "127.0.0.1:53"
+	//单次DNS查询的默认超时
+	dnsTimeout = 5 * time.Second
+	//按记录TTL刷新时的最短和最长间隔
+	minDNSRefresh = time.Second
+	maxDNSRefresh = 5 * time.Minute
+	//刷新失败后的重试间隔，从未查询成功的服务在该时间内直接返回上次的错误
+	dnsRetryInterval = 5 * time.Second
+)
+
+var (
+	ErrDNSResponse = errors.New("unexpected dns response")
+	ErrDNSRcode    = errors.New("dns query failed")
+)
+
+//基于DNS SRV记录的服务发现，服务 name 对应的SRV记录为 _name._tcp.<Domain>
+//只使用优先级最高（Priority最小）的一组记录，SRV的Weight作为实例权重；
+//目标地址优先使用响应中附带的A记录，否则再查询一次A记录
+//首次发现某个服务后按记录的TTL（或固定的RefreshInterval）在后台刷新，刷新失败时保留上一次的结果，
+//超过maxStaleness仍未刷新成功时不再返回
+type DNSDiscoveryClient struct {
+	//DNS服务器地址 host:port
+	Resolver string
+	//SRV记录所在的域，例如 service.consul 或 svc.cluster.local
+	Domain string
+	//固定的刷新间隔，为0时按记录的TTL刷新
+	RefreshInterval time.Duration
+
+	logger *log.Logger
+
+	mutex      sync.Mutex
+	cache      *instanceCache
+	refreshing map[string]bool
+
+	watchers *watchers
+	stopOnce sync.Once
+	stopC    chan struct{}
+}
+
+//resolver为空时使用/etc/resolv.conf中的第一个nameserver
+func NewDNSDiscoveryClient(resolver, domain string, refreshInterval, maxStaleness time.Duration, logger *log.Logger) *DNSDiscoveryClient {
+	if resolver == "" {
+		resolver = systemResolver()
+	} else if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	return &DNSDiscoveryClient{
+		Resolver:        resolver,
+		Domain:          domain,
+		RefreshInterval: refreshInterval,
+		logger:          logger,
+		cache:           newInstanceCache(BackendDNS, maxStaleness),
+		refreshing:      make(map[string]bool),
+		watchers:        newWatchers(),
+		stopC:           make(chan struct{}),
+	}
+}
+
+//读取/etc/resolv.conf中的第一个nameserver
+func systemResolver() string {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return defaultDNSResolver
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return defaultDNSResolver
+}
+
+//DNS记录由外部发布，注册为空操作
+func (client *DNSDiscoveryClient) Register(ctx context.Context, registration *Registration) error {
+	return nil
+}
+
+//DNS记录由外部发布，注销为空操作
+func (client *DNSDiscoveryClient) Deregister(ctx context.Context, instanceID string) error {
+	return nil
+}
+
+//serviceName可以带查询参数，见ServiceQuery
+func (client *DNSDiscoveryClient) DiscoverServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+	instances, err := client.instances(ctx, query.Name)
+	if err != nil {
+		return nil, err
+	}
+	return query.Filter(instances), nil
+}
+
+func (client *DNSDiscoveryClient) instances(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	if instances, ok, err := client.cache.get(serviceName); ok {
+		return instances, err
+	}
+	//DNS服务器不可用时避免每次调用都同步查询并等待超时
+	if failedAt, err := client.cache.lastFailure(serviceName); err != nil && time.Since(failedAt) < dnsRetryInterval {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+
+	instances, ttl, err := client.resolve(ctx, serviceName)
+	if err != nil {
+		client.cache.fail(serviceName, err)
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+	client.cache.store(serviceName, instances)
+	client.mutex.Lock()
+	start := !client.refreshing[serviceName]
+	client.refreshing[serviceName] = true
+	client.mutex.Unlock()
+	if start {
+		go client.refresh(serviceName, ttl)
+	}
+	return instances, nil
+}
+
+//订阅服务的实例变化，通道中首先是当前的实例列表，调用cancel取消订阅
+func (client *DNSDiscoveryClient) Watch(serviceName string) (<-chan []*ServiceInstance, func()) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		client.logger.Println("watch dns service", serviceName, "error:", err)
+		return client.watchers.add(&ServiceQuery{Name: serviceName}, nil)
+	}
+	return client.watchers.add(query, func() []*ServiceInstance {
+		instances, err := client.instances(context.Background(), query.Name)
+		if err != nil {
+			client.logger.Println(err)
+		}
+		return instances
+	})
+}
+
+//停止后台刷新并关闭所有订阅
+func (client *DNSDiscoveryClient) Close() {
+	client.stopOnce.Do(func() {
+		close(client.stopC)
+		client.watchers.closeAll()
+		client.cache.close()
+	})
+}
+
+//按TTL刷新服务的实例列表，变化时通知订阅者
+func (client *DNSDiscoveryClient) refresh(serviceName string, ttl time.Duration) {
+	wait := client.refreshDelay(ttl)
+	for {
+		select {
+		case <-client.stopC:
+			return
+		case <-time.After(wait):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		instances, ttl, err := client.resolve(ctx, serviceName)
+		cancel()
+		if err != nil {
+			client.cache.fail(serviceName, err)
+			client.logger.Println("refresh dns service", serviceName, "error:", err)
+			wait = dnsRetryInterval
+			continue
+		}
+		wait = client.refreshDelay(ttl)
+
+		if client.cache.store(serviceName, instances) {
+			client.watchers.notify(serviceName, instances)
+		}
+	}
+}
+
+func (client *DNSDiscoveryClient) refreshDelay(ttl time.Duration) time.Duration {
+	if client.RefreshInterval > 0 {
+		return client.RefreshInterval
+	}
+	if ttl < minDNSRefresh {
+		return minDNSRefresh
+	}
+	if ttl > maxDNSRefresh {
+		return maxDNSRefresh
+	}
+	return ttl
+}
+
+//SRV记录名称 _name._tcp.<domain>.
+func (client *DNSDiscoveryClient) srvName(serviceName string) string {
+	name := "_" + serviceName + "._tcp"
+	if domain := strings.Trim(client.Domain, "."); domain != "" {
+		name += "." + domain
+	}
+	return name + "."
+}
+
+//查询服务的SRV记录，返回实例列表和记录的最小TTL，记录不存在时返回空列表
+func (client *DNSDiscoveryClient) resolve(ctx context.Context, serviceName string) ([]*ServiceInstance, time.Duration, error) {
+	response, err := client.query(ctx, client.srvName(serviceName), dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ttl uint32
+	minTTL := func(t uint32) {
+		if ttl == 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	//附带的A记录
+	addresses := make(map[string]string)
+	for _, resource := range response.Additionals {
+		if a, ok := resource.Body.(*dnsmessage.AResource); ok {
+			addresses[strings.ToLower(resource.Header.Name.String())] = net.IP(a.A[:]).String()
+			minTTL(resource.Header.TTL)
+		}
+	}
+
+	var records []*dnsmessage.SRVResource
+	for _, resource := range response.Answers {
+		srv, ok := resource.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		minTTL(resource.Header.TTL)
+		if len(records) > 0 && srv.Priority > records[0].Priority {
+			continue
+		}
+		if len(records) > 0 && srv.Priority < records[0].Priority {
+			records = records[:0]
+		}
+		records = append(records, srv)
+	}
+
+	instances := make([]*ServiceInstance, 0, len(records))
+	for _, srv := range records {
+		target := strings.ToLower(srv.Target.String())
+		host, ok := addresses[target]
+		if !ok {
+			host, err = client.lookupA(ctx, target, minTTL)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		weight := int(srv.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		instances = append(instances, &ServiceInstance{
+			ID:     strings.TrimSuffix(target, ".") + ":" + strconv.Itoa(int(srv.Port)),
+			Name:   serviceName,
+			Host:   host,
+			Port:   int(srv.Port),
+			Weight: weight,
+			Health: HealthPassing,
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+	return instances, time.Duration(ttl) * time.Second, nil
+}
+
+//查询目标的A记录，没有A记录时使用目标域名作为地址
+func (client *DNSDiscoveryClient) lookupA(ctx context.Context, target string, minTTL func(uint32)) (string, error) {
+	response, err := client.query(ctx, target, dnsmessage.TypeA)
+	if err != nil {
+		return "", err
+	}
+	for _, resource := range response.Answers {
+		if a, ok := resource.Body.(*dnsmessage.AResource); ok {
+			minTTL(resource.Header.TTL)
+			return net.IP(a.A[:]).String(), nil
+		}
+	}
+	return strings.TrimSuffix(target, "."), nil
+}
+
+//向DNS服务器发送查询，UDP响应被截断时改用TCP重新查询
+//NXDOMAIN视为记录不存在，返回空响应
+func (client *DNSDiscoveryClient) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	request := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := request.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.exchange(ctx, "udp", packed, request.Header.ID)
+	if err == nil && response.Header.Truncated {
+		response, err = client.exchange(ctx, "tcp", packed, request.Header.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		return response, nil
+	case dnsmessage.RCodeNameError:
+		return &dnsmessage.Message{}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrDNSRcode, response.Header.RCode)
+}
+
+func (client *DNSDiscoveryClient) exchange(ctx context.Context, network string, packed []byte, id uint16) (*dnsmessage.Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, client.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var buf []byte
+	if network == "tcp" {
+		//TCP查询使用2字节的长度前缀
+		frame := make([]byte, 2+len(packed))
+		binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+		copy(frame[2:], packed)
+		if _, err := conn.Write(frame); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	response := &dnsmessage.Message{}
+	if err := response.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if response.Header.ID != id || !response.Header.Response {
+		return nil, ErrDNSResponse
+	}
+	return response, nil
+}
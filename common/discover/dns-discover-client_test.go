@@ -0,0 +1,269 @@
+package discover
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+//进程内的DNS服务器，同一端口同时监听UDP和TCP
+type fakeDNS struct {
+	t    *testing.T
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+
+	mutex sync.Mutex
+	//按 查询名/类型 返回的响应，tcp表示查询是否通过TCP
+	handlers map[string]func(tcp bool) dnsmessage.Message
+	queries  map[string]int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	server := &fakeDNS{
+		t:        t,
+		handlers: make(map[string]func(tcp bool) dnsmessage.Message),
+		queries:  make(map[string]int),
+	}
+	//随机分配的UDP端口在TCP上可能已被占用，多试几次
+	for i := 0; i < 10 && server.tcp == nil; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			continue
+		}
+		server.udp, server.tcp, server.addr = udp, tcp, udp.LocalAddr().String()
+	}
+	if server.tcp == nil {
+		t.Fatal("no free port for both udp and tcp")
+	}
+	go server.serveUDP()
+	go server.serveTCP()
+	return server
+}
+
+func (server *fakeDNS) Close() {
+	server.udp.Close()
+	server.tcp.Close()
+}
+
+func (server *fakeDNS) handle(name string, qtype dnsmessage.Type, handler func(tcp bool) dnsmessage.Message) {
+	server.mutex.Lock()
+	server.handlers[name+"/"+qtype.String()] = handler
+	server.mutex.Unlock()
+}
+
+func (server *fakeDNS) count(name string, qtype dnsmessage.Type) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.queries[name+"/"+qtype.String()]
+}
+
+func (server *fakeDNS) reply(packet []byte, tcp bool) []byte {
+	var request dnsmessage.Message
+	if err := request.Unpack(packet); err != nil || len(request.Questions) != 1 {
+		return nil
+	}
+	question := request.Questions[0]
+	key := question.Name.String() + "/" + question.Type.String()
+	server.mutex.Lock()
+	server.queries[key]++
+	handler, ok := server.handlers[key]
+	server.mutex.Unlock()
+
+	response := dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}
+	if ok {
+		response = handler(tcp)
+	}
+	response.Header.ID = request.Header.ID
+	response.Header.Response = true
+	response.Questions = request.Questions
+	packed, err := response.Pack()
+	if err != nil {
+		server.t.Error(err)
+		return nil
+	}
+	return packed
+}
+
+func (server *fakeDNS) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := server.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if packed := server.reply(buf[:n], false); packed != nil {
+			server.udp.WriteTo(packed, addr)
+		}
+	}
+}
+
+func (server *fakeDNS) serveTCP() {
+	for {
+		conn, err := server.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, packet); err != nil {
+				return
+			}
+			packed := server.reply(packet, true)
+			frame := make([]byte, 2+len(packed))
+			binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+			copy(frame[2:], packed)
+			conn.Write(frame)
+		}(conn)
+	}
+}
+
+func mustName(name string) dnsmessage.Name {
+	return dnsmessage.MustNewName(name)
+}
+
+func srvRecord(name string, priority, weight, port uint16, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(name), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 30},
+		Body:   &dnsmessage.SRVResource{Priority: priority, Weight: weight, Port: port, Target: mustName(target)},
+	}
+}
+
+func aRecord(name string, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
+
+func newTestDNSClient(server *fakeDNS) *DNSDiscoveryClient {
+	return NewDNSDiscoveryClient(server.addr, "test", 0, 0, log.New(ioutil.Discard, "", 0))
+}
+
+func TestDNSDiscoverServices(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.Close()
+	client := newTestDNSClient(server)
+	defer client.Close()
+
+	server.handle("_string._tcp.test.", dnsmessage.TypeSRV, func(bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Answers: []dnsmessage.Resource{
+				srvRecord("_string._tcp.test.", 20, 1, 8003, "c.test."),
+				srvRecord("_string._tcp.test.", 10, 5, 8001, "a.test."),
+				srvRecord("_string._tcp.test.", 10, 0, 8002, "b.test."),
+			},
+			//b.test没有附带的A记录，需要再查询一次
+			Additionals: []dnsmessage.Resource{aRecord("a.test.", [4]byte{10, 0, 0, 1})},
+		}
+	})
+	server.handle("b.test.", dnsmessage.TypeA, func(bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord("b.test.", [4]byte{10, 0, 0, 2})}}
+	})
+
+	instances, err := client.DiscoverServices(context.Background(), "string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ServiceInstance{
+		{ID: "a.test:8001", Name: "string", Host: "10.0.0.1", Port: 8001, Weight: 5, Health: HealthPassing},
+		{ID: "b.test:8002", Name: "string", Host: "10.0.0.2", Port: 8002, Weight: 1, Health: HealthPassing},
+	}
+	if len(instances) != len(expected) {
+		t.Fatalf("got %d instances, want %d", len(instances), len(expected))
+	}
+	for i, instance := range instances {
+		want := expected[i]
+		if instance.ID != want.ID || instance.Name != want.Name || instance.Host != want.Host ||
+			instance.Port != want.Port || instance.Weight != want.Weight || instance.Health != want.Health {
+			t.Errorf("instance %d = %+v, want %+v", i, *instance, want)
+		}
+	}
+	if n := server.count("a.test.", dnsmessage.TypeA); n != 0 {
+		t.Errorf("queried A record of a.test %d times, want 0", n)
+	}
+	if n := server.count("c.test.", dnsmessage.TypeA); n != 0 {
+		t.Errorf("queried A record of lower priority target %d times, want 0", n)
+	}
+}
+
+func TestDNSTruncatedFallsBackToTCP(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.Close()
+	client := newTestDNSClient(server)
+	defer client.Close()
+
+	server.handle("_string._tcp.test.", dnsmessage.TypeSRV, func(tcp bool) dnsmessage.Message {
+		if !tcp {
+			return dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+		}
+		return dnsmessage.Message{
+			Answers:     []dnsmessage.Resource{srvRecord("_string._tcp.test.", 10, 1, 8001, "a.test.")},
+			Additionals: []dnsmessage.Resource{aRecord("a.test.", [4]byte{10, 0, 0, 1})},
+		}
+	})
+
+	instances, err := client.DiscoverServices(context.Background(), "string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Host != "10.0.0.1" || instances[0].Port != 8001 {
+		t.Fatalf("got %v, want a single instance 10.0.0.1:8001", instances)
+	}
+	if n := server.count("_string._tcp.test.", dnsmessage.TypeSRV); n != 2 {
+		t.Errorf("got %d SRV queries, want 2 (udp and tcp)", n)
+	}
+}
+
+func TestDNSNameErrorReturnsNoInstances(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.Close()
+	client := newTestDNSClient(server)
+	defer client.Close()
+
+	instances, err := client.DiscoverServices(context.Background(), "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("got %v, want no instances", instances)
+	}
+}
+
+func TestDNSFailureBackoff(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.Close()
+	client := newTestDNSClient(server)
+	defer client.Close()
+
+	server.handle("_string._tcp.test.", dnsmessage.TypeSRV, func(bool) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := client.DiscoverServices(context.Background(), "string")
+		if !errors.Is(err, ErrDNSRcode) {
+			t.Fatalf("call %d: got error %v, want %v", i, err, ErrDNSRcode)
+		}
+	}
+	if n := server.count("_string._tcp.test.", dnsmessage.TypeSRV); n != 1 {
+		t.Errorf("got %d SRV queries, want 1 within the retry interval", n)
+	}
+}
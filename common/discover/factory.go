@@ -0,0 +1,54 @@
+package discover
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+//服务发现后端
+const (
+	BackendConsul   = "consul"
+	BackendFile     = "file"
+	BackendDNS      = "dns"
+	BackendRegistry = "registry"
+)
+
+var ErrUnknownBackend = errors.New("unknown discovery backend")
+
+//服务发现客户端参数，按Backend使用对应的字段
+type Options struct {
+	Backend string
+	//后端不可用时缓存的实例列表最多使用多久，为0时一直使用
+	MaxStaleness time.Duration
+
+	ConsulHost string
+	ConsulPort int
+
+	//服务发现文件及检查文件变化的间隔
+	File         string
+	FileInterval time.Duration
+
+	//DNS服务器、SRV记录所在的域及固定刷新间隔（为0时按TTL刷新）
+	DNSResolver string
+	DNSDomain   string
+	DNSRefresh  time.Duration
+
+	//内置注册中心地址
+	RegistryAddress string
+}
+
+//根据后端名称创建服务发现客户端
+func NewDiscoveryClientV2(options Options, logger *log.Logger) (DiscoveryClientV2, error) {
+	switch options.Backend {
+	case BackendConsul, "":
+		return NewKitDiscoverClientV2(options.ConsulHost, options.ConsulPort, options.MaxStaleness, logger)
+	case BackendFile:
+		return NewFileDiscoveryClient(options.File, options.FileInterval, logger)
+	case BackendDNS:
+		return NewDNSDiscoveryClient(options.DNSResolver, options.DNSDomain, options.DNSRefresh, options.MaxStaleness, logger), nil
+	case BackendRegistry:
+		return NewRegistryDiscoveryClient(options.RegistryAddress, DefaultRegistryTTL, options.MaxStaleness, logger), nil
+	}
+	return nil, ErrUnknownBackend
+}
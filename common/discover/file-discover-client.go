@@ -0,0 +1,251 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//服务发现文件格式，按服务名列出实例：
+//services:
+//  string:
+//  - id: string-1
+//    host: 127.0.0.1
+//    port: 10085
+//    weight: 2
+//    tags: [v1]
+//    meta: {zone: a}
+//    health: passing
+type FileConfig struct {
+	Services map[string][]*FileInstance `json:"services" yaml:"services"`
+}
+
+//文件中的服务实例，id为空时使用 host:port，weight为0时为1，health为空时为passing
+type FileInstance struct {
+	ID     string            `json:"id" yaml:"id"`
+	Host   string            `json:"host" yaml:"host"`
+	Port   int               `json:"port" yaml:"port"`
+	Weight int               `json:"weight" yaml:"weight"`
+	Tags   []string          `json:"tags" yaml:"tags"`
+	Meta   map[string]string `json:"meta" yaml:"meta"`
+	Health string            `json:"health" yaml:"health"`
+}
+
+var ErrInvalidInstance = errors.New("instance host and port are required")
+
+//基于静态文件的服务发现，用于本地开发和测试，不依赖consul
+//定时检查文件内容，变化后重新加载并通知订阅者；
+//Register注册的实例只保存在当前进程中，与文件中的实例合并后返回
+type FileDiscoveryClient struct {
+	path     string
+	interval time.Duration
+	logger   *log.Logger
+
+	mutex sync.RWMutex
+	data  []byte
+	//文件中的实例，按服务名
+	fileServices map[string][]*ServiceInstance
+	//通过Register注册的实例，按实例ID
+	registered map[string]*ServiceInstance
+
+	watchers *watchers
+	stopOnce sync.Once
+	stopC    chan struct{}
+}
+
+//加载服务发现文件，interval大于0时定时检查文件变化
+func NewFileDiscoveryClient(path string, interval time.Duration, logger *log.Logger) (*FileDiscoveryClient, error) {
+	client := &FileDiscoveryClient{
+		path:       path,
+		interval:   interval,
+		logger:     logger,
+		registered: make(map[string]*ServiceInstance),
+		watchers:   newWatchers(),
+		stopC:      make(chan struct{}),
+	}
+	if _, err := client.load(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go client.watchFile()
+	}
+	return client, nil
+}
+
+//解析服务发现文件，.json使用JSON格式，其他使用YAML格式
+func ParseFileConfig(name string, data []byte) (map[string][]*ServiceInstance, error) {
+	config := &FileConfig{}
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		err = json.Unmarshal(data, config)
+	default:
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string][]*ServiceInstance, len(config.Services))
+	for serviceName, instances := range config.Services {
+		for _, instance := range instances {
+			if instance == nil || instance.Host == "" || instance.Port <= 0 {
+				return nil, fmt.Errorf("service %s: %v", serviceName, ErrInvalidInstance)
+			}
+			services[serviceName] = append(services[serviceName], instance.serviceInstance(serviceName))
+		}
+	}
+	return services, nil
+}
+
+func (instance *FileInstance) serviceInstance(serviceName string) *ServiceInstance {
+	serviceInstance := &ServiceInstance{
+		ID:     instance.ID,
+		Name:   serviceName,
+		Host:   instance.Host,
+		Port:   instance.Port,
+		Weight: instance.Weight,
+		Tags:   instance.Tags,
+		Meta:   instance.Meta,
+		Health: instance.Health,
+	}
+	if serviceInstance.ID == "" {
+		serviceInstance.ID = serviceInstance.Address()
+	}
+	if serviceInstance.Weight <= 0 {
+		serviceInstance.Weight = 1
+	}
+	if serviceInstance.Health == "" {
+		serviceInstance.Health = HealthPassing
+	}
+	return serviceInstance
+}
+
+//读取服务发现文件，内容未变化时返回false
+func (client *FileDiscoveryClient) load() (bool, error) {
+	data, err := ioutil.ReadFile(client.path)
+	if err != nil {
+		return false, err
+	}
+	client.mutex.RLock()
+	unchanged := client.fileServices != nil && bytes.Equal(data, client.data)
+	client.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	services, err := ParseFileConfig(client.path, data)
+	if err != nil {
+		return false, err
+	}
+	client.mutex.Lock()
+	client.data = data
+	client.fileServices = services
+	client.mutex.Unlock()
+	return true, nil
+}
+
+//定时检查文件内容，变化后通知所有订阅者
+func (client *FileDiscoveryClient) watchFile() {
+	ticker := time.NewTicker(client.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.stopC:
+			return
+		case <-ticker.C:
+			changed, err := client.load()
+			if err != nil {
+				client.logger.Println("load discovery file error:", err)
+				continue
+			}
+			if changed {
+				client.logger.Println("discovery file reloaded:", client.path)
+				for _, serviceName := range client.watchers.services() {
+					client.watchers.notify(serviceName, client.instances(serviceName))
+				}
+			}
+		}
+	}
+}
+
+//Register注册的实例只在当前进程中可见
+func (client *FileDiscoveryClient) Register(ctx context.Context, registration *Registration) error {
+	if registration.ServiceName == "" || registration.InstanceID == "" {
+		return &Error{Op: OpRegister, Service: registration.ServiceName, InstanceID: registration.InstanceID, Err: ErrInvalidRegistration}
+	}
+	client.mutex.Lock()
+	client.registered[registration.InstanceID] = &ServiceInstance{
+		ID:     registration.InstanceID,
+		Name:   registration.ServiceName,
+		Host:   registration.Host,
+		Port:   registration.Port,
+		Weight: 1,
+		Tags:   registration.Tags,
+		Meta:   registration.Meta,
+		Health: HealthPassing,
+	}
+	client.mutex.Unlock()
+	client.watchers.notify(registration.ServiceName, client.instances(registration.ServiceName))
+	return nil
+}
+
+func (client *FileDiscoveryClient) Deregister(ctx context.Context, instanceID string) error {
+	client.mutex.Lock()
+	instance, ok := client.registered[instanceID]
+	delete(client.registered, instanceID)
+	client.mutex.Unlock()
+	if ok {
+		client.watchers.notify(instance.Name, client.instances(instance.Name))
+	}
+	return nil
+}
+
+//返回文件中和当前进程注册的实例，serviceName可以带查询参数，见ServiceQuery
+func (client *FileDiscoveryClient) DiscoverServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+	return query.Filter(client.instances(query.Name)), nil
+}
+
+//订阅服务的实例变化，通道中首先是当前的实例列表，调用cancel取消订阅
+func (client *FileDiscoveryClient) Watch(serviceName string) (<-chan []*ServiceInstance, func()) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		client.logger.Println("watch file service", serviceName, "error:", err)
+		return client.watchers.add(&ServiceQuery{Name: serviceName}, nil)
+	}
+	return client.watchers.add(query, func() []*ServiceInstance {
+		return client.instances(query.Name)
+	})
+}
+
+//停止检查文件并关闭所有订阅
+func (client *FileDiscoveryClient) Close() {
+	client.stopOnce.Do(func() {
+		close(client.stopC)
+		client.watchers.closeAll()
+	})
+}
+
+func (client *FileDiscoveryClient) instances(serviceName string) []*ServiceInstance {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	instances := make([]*ServiceInstance, 0, len(client.fileServices[serviceName]))
+	instances = append(instances, client.fileServices[serviceName]...)
+	for _, instance := range client.registered {
+		if instance.Name == serviceName {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
@@ -0,0 +1,94 @@
+package discover
+
+import (
+	"github.com/hashicorp/consul/api"
+	"strconv"
+)
+
+//服务实例健康状态
+const (
+	HealthPassing     = "passing"
+	HealthWarning     = "warning"
+	HealthCritical    = "critical"
+	HealthMaintenance = "maintenance"
+)
+
+//服务实例，由DiscoveryClient返回、供负载均衡使用，与具体的注册中心无关
+//DiscoveryClient返回的实例可能被缓存共享，调用方不应修改
+type ServiceInstance struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	//负载均衡权重，至少为1
+	Weight int               `json:"weight"`
+	Tags   []string          `json:"tags,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+	//健康状态：passing、warning、critical、maintenance
+	Health string `json:"health"`
+}
+
+//实例地址 host:port
+func (instance *ServiceInstance) Address() string {
+	return instance.Host + ":" + strconv.Itoa(instance.Port)
+}
+
+//将consul的服务实例转换为ServiceInstance
+//权重优先使用Meta中的weight，其次使用consul的Weights.Passing，默认为1
+func newConsulInstance(service *api.AgentService, health string) *ServiceInstance {
+	weight := 1
+	if w, err := strconv.Atoi(service.Meta["weight"]); err == nil && w > 0 {
+		weight = w
+	} else if service.Weights.Passing > 0 {
+		weight = service.Weights.Passing
+	}
+	return &ServiceInstance{
+		ID:     service.ID,
+		Name:   service.Service,
+		Host:   service.Address,
+		Port:   service.Port,
+		Weight: weight,
+		Tags:   service.Tags,
+		Meta:   service.Meta,
+		Health: health,
+	}
+}
+
+//两个实例列表的ID、地址、权重、健康状态、标签和元数据是否相同，顺序不同视为不同
+func sameInstances(a, b []*ServiceInstance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Host != b[i].Host || a[i].Port != b[i].Port ||
+			a[i].Weight != b[i].Weight || a[i].Health != b[i].Health ||
+			!sameTags(a[i].Tags, b[i].Tags) || !sameMeta(a[i].Meta, b[i].Meta) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -1,24 +1,60 @@
 package discover
 
 import (
+	"context"
+	"errors"
 	"github.com/go-kit/kit/sd/consul"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
 	"log"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 )
 
+const (
+	//阻塞查询的等待时间
+	consulWaitTime = 5 * time.Minute
+	//阻塞查询失败后的重试间隔，每次失败翻倍
+	consulMinBackoff = time.Second
+	consulMaxBackoff = 30 * time.Second
+)
+
+//基于kit的consul客户端
+//服务实例按服务名缓存，首次发现某个服务后在后台使用阻塞查询监控实例变化，
+//查询失败时按退避间隔重试并继续返回缓存的实例，缓存超过maxStaleness未刷新时不再返回
 type KitConsulDiscoverClient struct {
-	Host         string
-	Port         int
-	client       consul.Client
-	config       *api.Config
-	mutex        sync.Mutex
-	instancesMap sync.Map
+	Host   string
+	Port   int
+	client consul.Client
+	agent  *api.Agent
+	config *api.Config
+	logger *log.Logger
+
+	mutex    sync.Mutex
+	cache    *instanceCache
+	watching map[string]bool
+	watchers *watchers
+	//ttl检查的实例按实例ID停止心跳
+	heartbeats map[string]chan struct{}
+	//心跳失败后的重新注册与Deregister串行执行，避免实例注销后又被心跳重新注册
+	registerMutex sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+//创建基于kit的consul客户端，返回原有的DiscoveryClient接口
 func NewKitDiscoverClient(consulHost string, consulPort int) (DiscoveryClient, error) {
+	client, err := NewKitDiscoverClientV2(consulHost, consulPort, 0, log.New(os.Stderr, "", log.LstdFlags))
+	if err != nil {
+		return nil, err
+	}
+	return NewDiscoveryClientAdapter(client), nil
+}
+
+//maxStaleness为0时consul不可用期间一直返回最近一次的实例列表
+func NewKitDiscoverClientV2(consulHost string, consulPort int, maxStaleness time.Duration, logger *log.Logger) (*KitConsulDiscoverClient, error) {
 	//通过host和port,组成config创建一个client
 	consulConfig := api.DefaultConfig()
 	consulConfig.Address = consulHost + ":" + strconv.Itoa(consulPort)
@@ -27,127 +63,310 @@ func NewKitDiscoverClient(consulHost string, consulPort int) (DiscoveryClient, e
 		return nil, err
 	}
 	client := consul.NewClient(apiClient)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &KitConsulDiscoverClient{
-		Host:   consulHost,
-		Port:   consulPort,
-		config: consulConfig,
-		client: client,
-	}, err
+		Host:       consulHost,
+		Port:       consulPort,
+		config:     consulConfig,
+		client:     client,
+		agent:      apiClient.Agent(),
+		logger:     logger,
+		cache:      newInstanceCache(BackendConsul, maxStaleness),
+		watching:   make(map[string]bool),
+		watchers:   newWatchers(),
+		heartbeats: make(map[string]chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}, nil
+}
+
+//基于kit的consul服务注册，ttl检查的实例在后台发送心跳直到Deregister
+func (consulC *KitConsulDiscoverClient) Register(ctx context.Context, registration *Registration) error {
+	if registration.ServiceName == "" || registration.InstanceID == "" {
+		return &Error{Op: OpRegister, Service: registration.ServiceName, InstanceID: registration.InstanceID, Err: ErrInvalidRegistration}
+	}
+	check, err := registration.check()
+	if err != nil {
+		return &Error{Op: OpRegister, Service: registration.ServiceName, InstanceID: registration.InstanceID, Err: err}
+	}
+	if err := consulC.register(ctx, registration, check); err != nil {
+		return &Error{Op: OpRegister, Service: registration.ServiceName, InstanceID: registration.InstanceID, Err: err}
+	}
+	if check.Type != CheckTTL {
+		return nil
+	}
+
+	stopC := make(chan struct{})
+	consulC.mutex.Lock()
+	if old, ok := consulC.heartbeats[registration.InstanceID]; ok {
+		close(old)
+	}
+	consulC.heartbeats[registration.InstanceID] = stopC
+	consulC.mutex.Unlock()
+	go consulC.heartbeat(registration, check, stopC)
+	return nil
 }
 
-//基于kit的consul服务注册
-func (consulC *KitConsulDiscoverClient) Register(serviceName, instanceId, healthCheckUrl string, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+func (consulC *KitConsulDiscoverClient) register(ctx context.Context, registration *Registration, check Check) error {
 	//构建服务实例元数据
 	serviceRegistration := &api.AgentServiceRegistration{
-		ID:      instanceId,
-		Name:    serviceName,
-		Address: instanceHost,
-		Port:    instancePort,
-		Meta:    meta,
-		Check: &api.AgentServiceCheck{
-			DeregisterCriticalServiceAfter: "30s",
-			HTTP:                           "http://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl,
-			Interval:                       "15s",
-		},
+		ID:      registration.InstanceID,
+		Name:    registration.ServiceName,
+		Address: registration.Host,
+		Port:    registration.Port,
+		Tags:    registration.Tags,
+		Meta:    registration.Meta,
+		Check:   consulCheck(registration, check),
 	}
 
 	//发送服务注册到 consul
-	err := consulC.client.Register(serviceRegistration)
-	if err != nil {
-		log.Println("register service error")
-		return false
+	return withContext(ctx, func() error {
+		return consulC.client.Register(serviceRegistration)
+	})
+}
+
+//实例唯一的检查使用consul默认的检查ID，ttl检查按该ID发送心跳
+func consulCheckID(instanceID string) string {
+	return "service:" + instanceID
+}
+
+func consulCheck(registration *Registration, check Check) *api.AgentServiceCheck {
+	address := registration.Host + ":" + strconv.Itoa(registration.Port)
+	serviceCheck := &api.AgentServiceCheck{
+		CheckID: consulCheckID(registration.InstanceID),
+	}
+	switch check.Type {
+	case CheckHTTP:
+		serviceCheck.HTTP = "http://" + address + registration.HealthCheckUrl
+	case CheckTCP:
+		serviceCheck.TCP = address
+	case CheckGRPC:
+		serviceCheck.GRPC = address
+		if check.GRPCService != "" {
+			serviceCheck.GRPC += "/" + check.GRPCService
+		}
+		serviceCheck.GRPCUseTLS = check.GRPCUseTLS
+	case CheckTTL:
+		serviceCheck.TTL = check.TTL.String()
+	}
+	if check.Type != CheckTTL {
+		serviceCheck.Interval = check.Interval.String()
 	}
+	if check.Timeout > 0 {
+		serviceCheck.Timeout = check.Timeout.String()
+	}
+	if check.DeregisterAfter > 0 {
+		serviceCheck.DeregisterCriticalServiceAfter = check.DeregisterAfter.String()
+	}
+	return serviceCheck
+}
 
-	log.Println("register service success")
-	return true
+//每TTL/3发送一次心跳，注册后立即发送一次使实例尽快变为passing，设置了Check.Status时上报其返回的状态；
+//心跳失败时（例如consul agent重启后丢失了注册信息）重新注册，Deregister之后不再重新注册
+func (consulC *KitConsulDiscoverClient) heartbeat(registration *Registration, check Check, stopC chan struct{}) {
+	interval := check.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	checkID := consulCheckID(registration.InstanceID)
+	for {
+		ctx, cancel := heartbeatContext(consulC.ctx, interval, stopC)
+		status, output := api.HealthPassing, ""
+		if check.Status != nil {
+			status, output = check.Status(ctx)
+		}
+		update := func() error {
+			return consulC.agent.UpdateTTL(checkID, output, status)
+		}
+		err := withContext(ctx, update)
+		if err != nil && ctx.Err() == nil {
+			consulC.logger.Println("heartbeat instance", registration.InstanceID, "error:", err)
+			if err = consulC.reregister(ctx, registration, check, stopC); err == nil {
+				err = withContext(ctx, update)
+			}
+			if err != nil && !errors.Is(err, context.Canceled) {
+				consulC.logger.Println("re-register instance", registration.InstanceID, "error:", err)
+			}
+		}
+		cancel()
+
+		select {
+		case <-stopC:
+			return
+		case <-consulC.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
-//基于kit的consul注销
-func (consulC *KitConsulDiscoverClient) Deregister(instanceId string, logger *log.Logger) bool {
+//心跳已停止时不再注册，返回context.Canceled
+func (consulC *KitConsulDiscoverClient) reregister(ctx context.Context, registration *Registration, check Check, stopC chan struct{}) error {
+	consulC.registerMutex.Lock()
+	defer consulC.registerMutex.Unlock()
+	select {
+	case <-stopC:
+		return context.Canceled
+	default:
+	}
+	return consulC.register(ctx, registration, check)
+}
+
+//基于kit的consul注销，同时停止该实例的心跳
+func (consulC *KitConsulDiscoverClient) Deregister(ctx context.Context, instanceID string) error {
+	consulC.mutex.Lock()
+	if stopC, ok := consulC.heartbeats[instanceID]; ok {
+		close(stopC)
+		delete(consulC.heartbeats, instanceID)
+	}
+	consulC.mutex.Unlock()
+	//等待进行中的重新注册结束，之后心跳不会再注册该实例
+	consulC.registerMutex.Lock()
+	defer consulC.registerMutex.Unlock()
+
 	//构建包含服务实例ID的元数据
 	serviceRegisteration := &api.AgentServiceRegistration{
-		ID: instanceId,
+		ID: instanceID,
 	}
 
 	//发送服务注销到consul
-	err := consulC.client.Deregister(serviceRegisteration)
+	err := withContext(ctx, func() error {
+		return consulC.client.Deregister(serviceRegisteration)
+	})
+	if err != nil {
+		return &Error{Op: OpDeregister, InstanceID: instanceID, Err: err}
+	}
+	return nil
+}
+
+//基于kit的服务发现，serviceName可以带查询参数，见ServiceQuery
+func (consulC *KitConsulDiscoverClient) DiscoverServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+	instances, err := consulC.instances(ctx, query.Name)
 	if err != nil {
-		logger.Println("deregister service err")
-		return false
+		return nil, err
 	}
-	log.Println("deregister service success")
-	return true
+	return query.Filter(instances), nil
 }
 
-//基于kit的服务发现
-func (consulC *KitConsulDiscoverClient) DiscoverServices(serviceName string, logger *log.Logger) []interface{} {
+//服务所有健康状态的实例，首次查询时启动阻塞查询监控实例变化
+func (consulC *KitConsulDiscoverClient) instances(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
 	//该服务已监控并缓存
-	instanceList, ok := consulC.instancesMap.Load(serviceName)
-	if ok {
-		return instanceList.([]interface{})
+	if instances, ok, err := consulC.cache.get(serviceName); ok {
+		return instances, err
 	}
 
-	//无缓存时
+	//无缓存或从未成功查询时
 	consulC.mutex.Lock()
-	//再次检查是否监控
-	instanceList, ok = consulC.instancesMap.Load(serviceName)
-	if ok {
-		return instanceList.([]interface{})
-	} else {
-		//注册并run 一个watch
-		go func() {
-			//使用consul服务实例来监控某个服务名的服务实例是否变化
-			params := make(map[string]interface{})
-			params["type"] = "service"
-			params["service"] = serviceName
-			//保留处理程序是为了向后兼容，但仅支持基于
-			//在索引参数上。 要支持基于哈希的监视，请设置HybridHandler。
-			plan, _ := watch.Parse(params)
-			plan.Handler = func(u uint64, i interface{}) {
-				if i == nil {
-					return
-				}
-				v, ok := i.([]*api.ServiceEntry)
-				if !ok {
-					return //数据异常
-				}
-				//没有服务实例在线
-				if len(v) == 0 {
-					consulC.instancesMap.Store(serviceName, []interface{}{})
-				}
-
-				var healthServices []interface{}
-				for _, service := range v {
-					//maintenance > critical > warning > passing
-					//当服务实例的状态为passing时
-					if service.Checks.AggregatedStatus() == api.HealthPassing {
-						//将此实例加入健康实例列表中
-						healthServices = append(healthServices, service.Service)
-					}
-				}
-				consulC.instancesMap.Store(serviceName, healthServices)
-			}
-			defer plan.Stop()
-			//run a watch plan
-			plan.Run(consulC.config.Address)
-
-		}()
-	}
 	defer consulC.mutex.Unlock()
+	//再次检查是否已缓存
+	if instances, ok, err := consulC.cache.get(serviceName); ok {
+		return instances, err
+	}
+	//注册并run 一个watch
+	if !consulC.watching[serviceName] && consulC.ctx.Err() == nil {
+		consulC.watching[serviceName] = true
+		go consulC.watch(serviceName)
+	}
+	//consul不可用时避免每次调用都同步查询
+	if failedAt, err := consulC.cache.lastFailure(serviceName); err != nil && time.Since(failedAt) < consulMinBackoff {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
 
 	//根据服务名请求服务列表
-	entries, _, err := consulC.client.Service(serviceName, "", false, nil)
+	entries, _, err := consulC.client.Service(serviceName, "", false, (&api.QueryOptions{}).WithContext(ctx))
 	if err != nil {
-		//没有可用的服务实例,注册此服务名称
-		consulC.instancesMap.Store(serviceName, []interface{}{})
-		logger.Println("discover service error")
-		return nil
+		consulC.cache.fail(serviceName, err)
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
 	}
+	instances := newConsulInstances(entries)
+	if consulC.cache.store(serviceName, instances) {
+		consulC.watchers.notify(serviceName, instances)
+	}
+	return instances, nil
+}
 
-	instances := make([]interface{}, len(entries))
-	for i := 0; i < len(instances); i++ {
-		instances[i] = entries[i].Service
+//使用阻塞查询监控服务实例变化，查询失败时按退避间隔重试，直到Close
+func (consulC *KitConsulDiscoverClient) watch(serviceName string) {
+	var index uint64
+	backoff := consulMinBackoff
+	for consulC.ctx.Err() == nil {
+		options := &api.QueryOptions{WaitIndex: index, WaitTime: consulWaitTime}
+		entries, meta, err := consulC.client.Service(serviceName, "", false, options.WithContext(consulC.ctx))
+		if err != nil {
+			if consulC.ctx.Err() != nil {
+				return
+			}
+			consulC.cache.fail(serviceName, err)
+			consulC.logger.Println("watch consul service", serviceName, "error:", err, "retry in", backoff)
+			select {
+			case <-consulC.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > consulMaxBackoff {
+				backoff = consulMaxBackoff
+			}
+			continue
+		}
+		backoff = consulMinBackoff
+		//索引变小（例如consul重建了状态）时从头开始
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		//实例变化时通知订阅者
+		instances := newConsulInstances(entries)
+		if consulC.cache.store(serviceName, instances) {
+			consulC.watchers.notify(serviceName, instances)
+		}
+	}
+}
+
+//按检查的聚合状态（maintenance > critical > warning > passing）设置实例的健康状态，
+//初次查询和阻塞查询使用相同的转换，由ServiceQuery统一筛选
+func newConsulInstances(entries []*api.ServiceEntry) []*ServiceInstance {
+	instances := make([]*ServiceInstance, 0, len(entries))
+	for _, entry := range entries {
+		instances = append(instances, newConsulInstance(entry.Service, entry.Checks.AggregatedStatus()))
 	}
-	consulC.instancesMap.Store(serviceName, instances)
 	return instances
 }
+
+//订阅服务的实例变化，由阻塞查询推送
+func (consulC *KitConsulDiscoverClient) Watch(serviceName string) (<-chan []*ServiceInstance, func()) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		consulC.logger.Println("watch consul service", serviceName, "error:", err)
+		return consulC.watchers.add(&ServiceQuery{Name: serviceName}, nil)
+	}
+	//consul暂时不可用时先推送空列表，恢复后推送实际的实例
+	return consulC.watchers.add(query, func() []*ServiceInstance {
+		instances, _ := consulC.instances(context.Background(), query.Name)
+		return instances
+	})
+}
+
+//停止所有阻塞查询和心跳并关闭所有订阅，不注销已注册的实例
+func (consulC *KitConsulDiscoverClient) Close() {
+	consulC.cancel()
+	consulC.watchers.closeAll()
+	consulC.cache.close()
+}
+
+//kit的consul客户端不支持context，在goroutine中执行请求，ctx结束时不再等待
+func withContext(ctx context.Context, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
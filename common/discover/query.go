@@ -0,0 +1,129 @@
+package discover
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+//服务查询中的保留参数，其他参数均为元数据选择条件
+const (
+	QueryTag    = "tag"
+	QueryHealth = "health"
+	//health=any 返回所有健康状态的实例
+	HealthAny = "any"
+)
+
+var ErrInvalidQuery = errors.New("invalid service query")
+
+//按标签、元数据和健康状态筛选服务实例
+//DiscoverServices和Watch的服务名可以带查询参数，例如：
+//  string?tag=primary&version=v2&health=passing,warning
+//tag可以出现多次或用逗号分隔，实例需要包含所有标签；其他参数为元数据，实例的元数据需要全部相等；
+//health为允许的健康状态，逗号分隔，默认只返回passing的实例
+type ServiceQuery struct {
+	Name   string
+	Tags   []string
+	Meta   map[string]string
+	Health []string
+}
+
+//解析带查询参数的服务名，不带参数时只按服务名查询健康的实例
+func ParseServiceQuery(service string) (*ServiceQuery, error) {
+	name, rawQuery := service, ""
+	if i := strings.IndexByte(service, '?'); i >= 0 {
+		name, rawQuery = service[:i], service[i+1:]
+	}
+	if name == "" {
+		return nil, ErrInvalidQuery
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, ErrInvalidQuery
+	}
+	query := &ServiceQuery{Name: name}
+	for key, vals := range values {
+		switch key {
+		case QueryTag:
+			query.Tags = append(query.Tags, splitList(vals)...)
+		case QueryHealth:
+			for _, health := range splitList(vals) {
+				switch health {
+				case HealthPassing, HealthWarning, HealthCritical, HealthMaintenance, HealthAny:
+					query.Health = append(query.Health, health)
+				default:
+					return nil, ErrInvalidQuery
+				}
+			}
+		default:
+			if key == "" || len(vals) != 1 {
+				return nil, ErrInvalidQuery
+			}
+			if query.Meta == nil {
+				query.Meta = make(map[string]string)
+			}
+			query.Meta[key] = vals[0]
+		}
+	}
+	return query, nil
+}
+
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+//实例是否满足查询条件
+func (query *ServiceQuery) Match(instance *ServiceInstance) bool {
+	if !query.matchHealth(instance.Health) {
+		return false
+	}
+	for key, value := range query.Meta {
+		if v, ok := instance.Meta[key]; !ok || v != value {
+			return false
+		}
+	}
+	for _, tag := range query.Tags {
+		found := false
+		for _, t := range instance.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (query *ServiceQuery) matchHealth(health string) bool {
+	if len(query.Health) == 0 {
+		return health == HealthPassing
+	}
+	for _, h := range query.Health {
+		if h == HealthAny || h == health {
+			return true
+		}
+	}
+	return false
+}
+
+//返回满足查询条件的实例，保持原有顺序
+func (query *ServiceQuery) Filter(instances []*ServiceInstance) []*ServiceInstance {
+	filtered := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if query.Match(instance) {
+			filtered = append(filtered, instance)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,316 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//内置注册中心的心跳超时，心跳间隔为其1/3
+	DefaultRegistryTTL = 30 * time.Second
+	//阻塞查询的等待时间
+	registryWait = 30 * time.Second
+	//阻塞查询失败后的重试间隔
+	registryRetryInterval = time.Second
+)
+
+//实例在注册中心中不存在，心跳时返回该错误后重新注册
+var ErrInstanceNotRegistered = errors.New("instance not registered")
+
+//内置注册中心（common/registry）的客户端，通过HTTP API注册、发送心跳和查询实例
+//首次发现某个服务后在后台使用阻塞查询监控实例变化，查询失败时保留上一次的结果，
+//超过maxStaleness仍未查询成功时不再返回
+type RegistryDiscoveryClient struct {
+	//注册中心地址，例如 http://127.0.0.1:8700
+	Address string
+	//注册实例的心跳超时
+	TTL time.Duration
+
+	httpClient *http.Client
+	logger     *log.Logger
+
+	mutex    sync.Mutex
+	cache    *instanceCache
+	watching map[string]bool
+	//按实例ID停止心跳
+	heartbeats map[string]chan struct{}
+	//心跳中的重新注册与Deregister串行执行，避免实例注销后又被心跳重新注册
+	registerMutex sync.Mutex
+
+	watchers *watchers
+	stopOnce sync.Once
+	stopC    chan struct{}
+}
+
+//address可以省略http://前缀，ttl不大于0时使用DefaultRegistryTTL
+func NewRegistryDiscoveryClient(address string, ttl, maxStaleness time.Duration, logger *log.Logger) *RegistryDiscoveryClient {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	if ttl <= 0 {
+		ttl = DefaultRegistryTTL
+	}
+	return &RegistryDiscoveryClient{
+		Address:    strings.TrimSuffix(address, "/"),
+		TTL:        ttl,
+		httpClient: &http.Client{},
+		logger:     logger,
+		cache:      newInstanceCache(BackendRegistry, maxStaleness),
+		watching:   make(map[string]bool),
+		heartbeats: make(map[string]chan struct{}),
+		watchers:   newWatchers(),
+		stopC:      make(chan struct{}),
+	}
+}
+
+//注册实例并在后台按TTL/3发送心跳，直到Deregister
+func (client *RegistryDiscoveryClient) Register(ctx context.Context, registration *Registration) error {
+	if registration.ServiceName == "" || registration.InstanceID == "" {
+		return &Error{Op: OpRegister, Service: registration.ServiceName, InstanceID: registration.InstanceID, Err: ErrInvalidRegistration}
+	}
+	if err := client.register(ctx, registration); err != nil {
+		return &Error{Op: OpRegister, Service: registration.ServiceName, InstanceID: registration.InstanceID, Err: err}
+	}
+
+	stopC := make(chan struct{})
+	client.mutex.Lock()
+	if old, ok := client.heartbeats[registration.InstanceID]; ok {
+		close(old)
+	}
+	client.heartbeats[registration.InstanceID] = stopC
+	client.mutex.Unlock()
+	go client.heartbeat(registration, stopC)
+	return nil
+}
+
+func (client *RegistryDiscoveryClient) register(ctx context.Context, registration *Registration) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":   registration.InstanceID,
+		"name": registration.ServiceName,
+		"host": registration.Host,
+		"port": registration.Port,
+		"tags": registration.Tags,
+		"meta": registration.Meta,
+		"ttl":  client.TTL.String(),
+	})
+	if err != nil {
+		return err
+	}
+	return client.do(ctx, http.MethodPut, "/v1/register", body, nil)
+}
+
+//定时发送心跳，注册中心中实例不存在时（例如注册中心重启）重新注册，Deregister之后不再重新注册
+func (client *RegistryDiscoveryClient) heartbeat(registration *Registration, stopC chan struct{}) {
+	ticker := time.NewTicker(client.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-client.stopC:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := heartbeatContext(context.Background(), client.TTL/3, stopC, client.stopC)
+		err := client.do(ctx, http.MethodPut, "/v1/heartbeat/"+url.PathEscape(registration.InstanceID), nil, nil)
+		if errors.Is(err, ErrInstanceNotRegistered) {
+			err = client.reregister(ctx, registration, stopC)
+		}
+		cancel()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			client.logger.Println("heartbeat instance", registration.InstanceID, "error:", err)
+		}
+	}
+}
+
+//心跳已停止时不再注册，返回context.Canceled
+func (client *RegistryDiscoveryClient) reregister(ctx context.Context, registration *Registration, stopC chan struct{}) error {
+	client.registerMutex.Lock()
+	defer client.registerMutex.Unlock()
+	select {
+	case <-stopC:
+		return context.Canceled
+	default:
+	}
+	return client.register(ctx, registration)
+}
+
+//停止心跳并注销实例
+func (client *RegistryDiscoveryClient) Deregister(ctx context.Context, instanceID string) error {
+	client.mutex.Lock()
+	if stopC, ok := client.heartbeats[instanceID]; ok {
+		close(stopC)
+		delete(client.heartbeats, instanceID)
+	}
+	client.mutex.Unlock()
+	//等待进行中的重新注册结束，之后心跳不会再注册该实例
+	client.registerMutex.Lock()
+	defer client.registerMutex.Unlock()
+	if err := client.do(ctx, http.MethodPut, "/v1/deregister/"+url.PathEscape(instanceID), nil, nil); err != nil {
+		return &Error{Op: OpDeregister, InstanceID: instanceID, Err: err}
+	}
+	return nil
+}
+
+//serviceName可以带查询参数，见ServiceQuery
+func (client *RegistryDiscoveryClient) DiscoverServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+	instances, err := client.instances(ctx, query.Name)
+	if err != nil {
+		return nil, err
+	}
+	return query.Filter(instances), nil
+}
+
+func (client *RegistryDiscoveryClient) instances(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	if instances, ok, err := client.cache.get(serviceName); ok {
+		return instances, err
+	}
+	//注册中心不可用时避免每次调用都同步查询
+	if failedAt, err := client.cache.lastFailure(serviceName); err != nil && time.Since(failedAt) < registryRetryInterval {
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+
+	instances, index, err := client.list(ctx, serviceName, 0)
+	if err != nil {
+		client.cache.fail(serviceName, err)
+		return nil, &Error{Op: OpDiscover, Service: serviceName, Err: err}
+	}
+	client.cache.store(serviceName, instances)
+	client.mutex.Lock()
+	start := !client.watching[serviceName]
+	client.watching[serviceName] = true
+	client.mutex.Unlock()
+	if start {
+		go client.watch(serviceName, index)
+	}
+	return instances, nil
+}
+
+//订阅服务的实例变化，通道中首先是当前的实例列表，调用cancel取消订阅
+func (client *RegistryDiscoveryClient) Watch(serviceName string) (<-chan []*ServiceInstance, func()) {
+	query, err := ParseServiceQuery(serviceName)
+	if err != nil {
+		client.logger.Println("watch registry service", serviceName, "error:", err)
+		return client.watchers.add(&ServiceQuery{Name: serviceName}, nil)
+	}
+	return client.watchers.add(query, func() []*ServiceInstance {
+		instances, err := client.instances(context.Background(), query.Name)
+		if err != nil {
+			client.logger.Println(err)
+		}
+		return instances
+	})
+}
+
+//停止心跳和阻塞查询并关闭所有订阅，不注销已注册的实例
+func (client *RegistryDiscoveryClient) Close() {
+	client.stopOnce.Do(func() {
+		close(client.stopC)
+		client.watchers.closeAll()
+		client.cache.close()
+	})
+}
+
+//使用阻塞查询监控服务的实例变化
+func (client *RegistryDiscoveryClient) watch(serviceName string, index uint64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-client.stopC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for ctx.Err() == nil {
+		instances, newIndex, err := client.list(ctx, serviceName, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			client.cache.fail(serviceName, err)
+			client.logger.Println("watch registry service", serviceName, "error:", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(registryRetryInterval):
+			}
+			continue
+		}
+		//注册中心重启后索引会变小，从头开始
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+		//阻塞查询超时未变化时同样刷新缓存时间
+		if client.cache.store(serviceName, instances) {
+			client.watchers.notify(serviceName, instances)
+		}
+	}
+}
+
+//查询服务的实例列表，index不为0时阻塞等待变化
+func (client *RegistryDiscoveryClient) list(ctx context.Context, serviceName string, index uint64) ([]*ServiceInstance, uint64, error) {
+	path := "/v1/services/" + url.PathEscape(serviceName)
+	if index > 0 {
+		path += "?index=" + strconv.FormatUint(index, 10) + "&wait=" + registryWait.String()
+	}
+	var instances []*ServiceInstance
+	header, err := client.get(ctx, path, &instances)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(header.Get("X-Registry-Index"), 10, 64)
+	return instances, newIndex, nil
+}
+
+func (client *RegistryDiscoveryClient) get(ctx context.Context, path string, v interface{}) (http.Header, error) {
+	var header http.Header
+	err := client.do(ctx, http.MethodGet, path, nil, func(resp *http.Response) error {
+		header = resp.Header
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+	return header, err
+}
+
+//发送请求，非2xx响应返回错误，心跳返回404时返回ErrInstanceNotRegistered
+func (client *RegistryDiscoveryClient) do(ctx context.Context, method, path string, body []byte, handle func(*http.Response) error) error {
+	req, err := http.NewRequest(method, client.Address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/v1/heartbeat/") {
+		return ErrInstanceNotRegistered
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("registry %s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if handle != nil {
+		return handle(resp)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package discover_test
+
+import (
+	"Hystrix/common/discover"
+	"Hystrix/common/registry"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRegistry() (*registry.Registry, *discover.RegistryDiscoveryClient, func()) {
+	logger := log.New(ioutil.Discard, "", 0)
+	r := registry.NewRegistry(logger)
+	r.Start(10 * time.Millisecond)
+	server := httptest.NewServer(registry.NewHandler(r))
+	//心跳间隔为TTL/3
+	client := discover.NewRegistryDiscoveryClient(server.URL, 150*time.Millisecond, 0, logger)
+	return r, client, func() {
+		client.Close()
+		server.Close()
+		r.Stop()
+	}
+}
+
+func testRegistration(id string, tags ...string) *discover.Registration {
+	return &discover.Registration{
+		ServiceName: "string",
+		InstanceID:  id,
+		Host:        "127.0.0.1",
+		Port:        8000,
+		Tags:        tags,
+	}
+}
+
+//等待条件成立，超时时测试失败
+func eventually(t *testing.T, message string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistryClientRegisterAndDiscover(t *testing.T) {
+	r, client, closeAll := newTestRegistry()
+	defer closeAll()
+	ctx := context.Background()
+
+	if err := client.Register(ctx, testRegistration("string-1", "primary")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Register(ctx, testRegistration("string-2")); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _ := r.Instances("string"); len(instances) != 2 {
+		t.Fatalf("registry has %d instances, want 2", len(instances))
+	}
+
+	instances, err := client.DiscoverServices(ctx, "string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 || instances[0].ID != "string-1" || instances[1].ID != "string-2" {
+		t.Fatalf("discovered %v, want string-1 and string-2", instances)
+	}
+	instances, err = client.DiscoverServices(ctx, "string?tag=primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].ID != "string-1" {
+		t.Fatalf("discovered %v with tag=primary, want string-1", instances)
+	}
+
+	if err := client.Deregister(ctx, "string-1"); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _ := r.Instances("string"); len(instances) != 1 || instances[0].ID != "string-2" {
+		t.Fatalf("registry has %v after deregister, want string-2", instances)
+	}
+}
+
+func TestRegistryClientRejectsInvalidRegistration(t *testing.T) {
+	_, client, closeAll := newTestRegistry()
+	defer closeAll()
+
+	err := client.Register(context.Background(), &discover.Registration{ServiceName: "string"})
+	if err == nil {
+		t.Fatal("registered an instance without id")
+	}
+}
+
+func TestRegistryClientWatch(t *testing.T) {
+	r, client, closeAll := newTestRegistry()
+	defer closeAll()
+
+	instancesC, cancel := client.Watch("string")
+	defer cancel()
+	if instances := <-instancesC; len(instances) != 0 {
+		t.Fatalf("initial instances %v, want none", instances)
+	}
+
+	//阻塞查询感知注册中心中的变化
+	r.Register(&discover.ServiceInstance{ID: "string-1", Name: "string", Host: "127.0.0.1", Port: 8000}, time.Minute)
+	select {
+	case instances := <-instancesC:
+		if len(instances) != 1 || instances[0].ID != "string-1" {
+			t.Fatalf("watched %v, want string-1", instances)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch was not notified of the new instance")
+	}
+	eventually(t, "discover did not see the new instance", func() bool {
+		instances, err := client.DiscoverServices(context.Background(), "string")
+		return err == nil && len(instances) == 1
+	})
+}
+
+func TestRegistryClientHeartbeat(t *testing.T) {
+	r, client, closeAll := newTestRegistry()
+	defer closeAll()
+
+	if err := client.Register(context.Background(), testRegistration("string-1")); err != nil {
+		t.Fatal(err)
+	}
+	//心跳保持实例在TTL之后仍然注册
+	time.Sleep(300 * time.Millisecond)
+	if instances, _ := r.Instances("string"); len(instances) != 1 {
+		t.Fatal("instance was not kept alive by heartbeats")
+	}
+
+	//注册中心丢失实例（例如重启）后，心跳返回404时重新注册
+	r.Deregister("string-1")
+	eventually(t, "instance was not registered again after the registry lost it", func() bool {
+		instances, _ := r.Instances("string")
+		return len(instances) == 1
+	})
+
+	//注销后停止心跳
+	if err := client.Deregister(context.Background(), "string-1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if instances, _ := r.Instances("string"); len(instances) != 0 {
+		t.Fatal("instance was registered again after deregister")
+	}
+}
+
+func TestRegistryClientDeregisterDuringReregister(t *testing.T) {
+	var registers, registered int32
+	reregistering := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/v1/register":
+			//第一次为Register，之后为心跳失败后的重新注册，阻塞到测试放行或请求被取消
+			ioutil.ReadAll(req.Body)
+			if atomic.AddInt32(&registers, 1) > 1 {
+				select {
+				case reregistering <- struct{}{}:
+				default:
+				}
+				select {
+				case <-release:
+				case <-req.Context().Done():
+					return
+				}
+			}
+			atomic.StoreInt32(&registered, 1)
+		case strings.HasPrefix(req.URL.Path, "/v1/deregister/"):
+			atomic.StoreInt32(&registered, 0)
+		case strings.HasPrefix(req.URL.Path, "/v1/heartbeat/"):
+			//注册中心始终认为实例不存在
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := discover.NewRegistryDiscoveryClient(server.URL, 150*time.Millisecond, 0, log.New(ioutil.Discard, "", 0))
+	defer client.Close()
+
+	if err := client.Register(context.Background(), testRegistration("string-1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reregistering:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat did not re-register the instance")
+	}
+
+	deregistered := make(chan error, 1)
+	go func() {
+		deregistered <- client.Deregister(context.Background(), "string-1")
+	}()
+	select {
+	case err := <-deregistered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deregister waited for the pending re-register")
+	}
+	//注销之后进行中的重新注册不能再生效
+	close(release)
+	time.Sleep(150 * time.Millisecond)
+	if atomic.LoadInt32(&registered) != 0 {
+		t.Fatal("instance was registered again after deregister")
+	}
+}
+
+func TestRegistryClientBacksOffAfterFailure(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := discover.NewRegistryDiscoveryClient(server.URL, 0, 0, log.New(ioutil.Discard, "", 0))
+	defer client.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.DiscoverServices(context.Background(), "string"); err == nil {
+			t.Fatal("discovered services from a failing registry")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("registry queried %d times, want 1 within the retry interval", n)
+	}
+}
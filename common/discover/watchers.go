@@ -0,0 +1,112 @@
+package discover
+
+import (
+	"sync"
+)
+
+//按服务名管理实例列表的订阅者，实例变化时按每个订阅者的查询条件筛选后通知
+//每个订阅者的通道只保留最新的实例列表，订阅者处理较慢时中间的变化会被合并
+type watchers struct {
+	mutex sync.Mutex
+	subs  map[string]map[chan []*ServiceInstance]*subscription
+}
+
+//订阅者的查询条件及最近一次推送的实例列表，sent为false时还未推送过
+type subscription struct {
+	query *ServiceQuery
+	last  []*ServiceInstance
+	sent  bool
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		subs: make(map[string]map[chan []*ServiceInstance]*subscription),
+	}
+}
+
+//订阅服务的实例变化，snapshot返回订阅时该服务未经筛选的实例列表，为nil时为空列表，取消订阅后通道被关闭
+//先加入订阅者再读取snapshot，读取期间发生的变化不会丢失；此时已推送的列表比snapshot更新，不再推送snapshot
+func (w *watchers) add(query *ServiceQuery, snapshot func() []*ServiceInstance) (<-chan []*ServiceInstance, func()) {
+	sub := &subscription{query: query}
+	ch := make(chan []*ServiceInstance, 1)
+	serviceName := query.Name
+	w.mutex.Lock()
+	if w.subs[serviceName] == nil {
+		w.subs[serviceName] = make(map[chan []*ServiceInstance]*subscription)
+	}
+	w.subs[serviceName][ch] = sub
+	w.mutex.Unlock()
+
+	var instances []*ServiceInstance
+	if snapshot != nil {
+		instances = snapshot()
+	}
+	w.mutex.Lock()
+	//closeAll之后通道已经关闭
+	if _, ok := w.subs[serviceName][ch]; ok && !sub.sent {
+		sub.last = query.Filter(instances)
+		sub.sent = true
+		ch <- sub.last
+	}
+	w.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			//closeAll之后通道已经关闭
+			if _, ok := w.subs[serviceName][ch]; !ok {
+				return
+			}
+			delete(w.subs[serviceName], ch)
+			if len(w.subs[serviceName]) == 0 {
+				delete(w.subs, serviceName)
+			}
+			close(ch)
+		})
+	}
+}
+
+//被订阅的服务名
+func (w *watchers) services() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	names := make([]string, 0, len(w.subs))
+	for name := range w.subs {
+		names = append(names, name)
+	}
+	return names
+}
+
+//通知服务的订阅者，instances为未经筛选的实例列表，筛选结果未变化的订阅者不通知
+func (w *watchers) notify(serviceName string, instances []*ServiceInstance) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for ch, sub := range w.subs[serviceName] {
+		filtered := sub.query.Filter(instances)
+		if sub.sent && sameInstances(sub.last, filtered) {
+			continue
+		}
+		sub.last = filtered
+		sub.sent = true
+		//丢弃订阅者尚未读取的旧列表，只在持有锁时发送，保证通道有空位
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- filtered
+	}
+}
+
+//关闭所有订阅
+func (w *watchers) closeAll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for name, subs := range w.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(w.subs, name)
+	}
+}
@@ -0,0 +1,75 @@
+package discover
+
+import (
+	"testing"
+)
+
+func watchedIDs(instances []*ServiceInstance) []string {
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = instance.ID
+	}
+	return ids
+}
+
+func TestWatchersKeepChangesDuringSnapshot(t *testing.T) {
+	a := &ServiceInstance{ID: "a", Name: "string", Health: HealthPassing}
+	b := &ServiceInstance{ID: "b", Name: "string", Health: HealthPassing}
+	tests := []struct {
+		name    string
+		initial []*ServiceInstance
+		changed []*ServiceInstance
+	}{
+		{"instance added", []*ServiceInstance{a}, []*ServiceInstance{a, b}},
+		{"all instances removed", []*ServiceInstance{a}, nil},
+		{"first instance registered", nil, []*ServiceInstance{a}},
+	}
+	for _, test := range tests {
+		w := newWatchers()
+		//读取订阅时的实例列表之后、返回之前服务发生变化
+		instancesC, cancel := w.add(&ServiceQuery{Name: "string"}, func() []*ServiceInstance {
+			w.notify("string", test.changed)
+			return test.initial
+		})
+		got := <-instancesC
+		if !sameInstances(got, test.changed) {
+			t.Errorf("%s: watched %v, want %v", test.name, watchedIDs(got), watchedIDs(test.changed))
+		}
+		select {
+		case instances := <-instancesC:
+			t.Errorf("%s: stale snapshot %v pushed after the change", test.name, watchedIDs(instances))
+		default:
+		}
+		cancel()
+	}
+}
+
+func TestWatchersFilterAndSkipUnchanged(t *testing.T) {
+	a := &ServiceInstance{ID: "a", Name: "string", Tags: []string{"primary"}, Health: HealthPassing}
+	b := &ServiceInstance{ID: "b", Name: "string", Health: HealthPassing}
+	w := newWatchers()
+	instancesC, cancel := w.add(&ServiceQuery{Name: "string", Tags: []string{"primary"}}, func() []*ServiceInstance {
+		return []*ServiceInstance{a}
+	})
+	defer cancel()
+	if got := <-instancesC; len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("initial instances %v, want a", watchedIDs(got))
+	}
+
+	//筛选结果未变化时不通知
+	w.notify("string", []*ServiceInstance{a, b})
+	select {
+	case got := <-instancesC:
+		t.Fatalf("notified %v although the filtered instances did not change", watchedIDs(got))
+	default:
+	}
+	w.notify("string", []*ServiceInstance{b})
+	if got := <-instancesC; len(got) != 0 {
+		t.Fatalf("watched %v, want none", watchedIDs(got))
+	}
+
+	w.closeAll()
+	if _, ok := <-instancesC; ok {
+		t.Fatal("channel is open after closeAll")
+	}
+}
@@ -0,0 +1,40 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//健康检查的HTTP路径
+const (
+	PathLive  = "/health/live"
+	PathReady = "/health/ready"
+)
+
+//响应状态码与consul HTTP检查的约定一致：2xx为passing，其他为critical
+//degraded的实例仍可提供服务（降级结果），返回200使其继续被服务发现返回，具体失败的检查见响应体
+var statusCodes = map[string]int{
+	StatusUp:       http.StatusOK,
+	StatusDegraded: http.StatusOK,
+	StatusDown:     http.StatusServiceUnavailable,
+}
+
+//存活检查，响应体为各检查的结果
+func (h *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeReport(rw, h.Live(req.Context()))
+	})
+}
+
+//就绪检查，down时返回503
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeReport(rw, h.Ready(req.Context()))
+	})
+}
+
+func writeReport(rw http.ResponseWriter, report *Report) {
+	rw.Header().Set("Content-Type", "application/json;charset=utf-8")
+	rw.WriteHeader(statusCodes[report.Status])
+	json.NewEncoder(rw).Encode(report)
+}
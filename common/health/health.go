@@ -0,0 +1,176 @@
+package health
+
+import (
+	"Hystrix/common/discover"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//健康状态
+const (
+	StatusUp = "up"
+	//非关键依赖不可用，仍然可以提供服务（例如只能返回降级结果）
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+)
+
+//单个检查的默认超时
+const DefaultTimeout = 2 * time.Second
+
+var ErrTimeout = errors.New("health check timeout")
+
+//健康检查，返回nil表示正常
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+//单个检查的结果
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	//是否为关键依赖，关键依赖失败时整体状态为down，否则为degraded
+	Critical bool `json:"critical"`
+}
+
+//一次检查的汇总，Status为所有检查中最差的状态
+type Report struct {
+	Status string             `json:"status"`
+	Checks map[string]*Result `json:"checks"`
+}
+
+type check struct {
+	name     string
+	checker  Checker
+	critical bool
+}
+
+//组件注册的健康检查，分为存活检查（进程是否需要重启）和就绪检查（是否可以接收流量）
+type Health struct {
+	timeout time.Duration
+
+	mutex     sync.RWMutex
+	liveness  []*check
+	readiness []*check
+}
+
+//timeout为单个检查的超时，不大于0时使用DefaultTimeout
+func New(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Health{timeout: timeout}
+}
+
+//注册存活检查，失败时整体状态为down
+func (h *Health) AddLiveness(name string, checker Checker) {
+	h.mutex.Lock()
+	h.liveness = append(h.liveness, &check{name: name, checker: checker, critical: true})
+	h.mutex.Unlock()
+}
+
+//注册就绪检查，critical为false时失败只将整体状态降为degraded
+func (h *Health) AddReadiness(name string, checker Checker, critical bool) {
+	h.mutex.Lock()
+	h.readiness = append(h.readiness, &check{name: name, checker: checker, critical: critical})
+	h.mutex.Unlock()
+}
+
+//执行所有存活检查
+func (h *Health) Live(ctx context.Context) *Report {
+	h.mutex.RLock()
+	checks := h.liveness
+	h.mutex.RUnlock()
+	return h.run(ctx, checks)
+}
+
+//执行所有就绪检查，存活检查失败时同样视为未就绪
+func (h *Health) Ready(ctx context.Context) *Report {
+	h.mutex.RLock()
+	checks := append(append([]*check(nil), h.liveness...), h.readiness...)
+	h.mutex.RUnlock()
+	return h.run(ctx, checks)
+}
+
+//并发执行检查，每个检查最多等待timeout
+func (h *Health) run(ctx context.Context, checks []*check) *Report {
+	report := &Report{Status: StatusUp, Checks: make(map[string]*Result, len(checks))}
+	results := make([]*Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			results[i] = h.runCheck(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i, c := range checks {
+		result := results[i]
+		report.Checks[c.name] = result
+		switch {
+		case result.Status == StatusDown:
+			report.Status = StatusDown
+		case result.Status == StatusDegraded && report.Status == StatusUp:
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+func (h *Health) runCheck(ctx context.Context, c *check) *Result {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- c.checker.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errC:
+	case <-ctx.Done():
+		err = ErrTimeout
+	}
+
+	result := &Result{Status: StatusUp, Critical: c.critical}
+	if err != nil {
+		result.Error = err.Error()
+		result.Status = StatusDegraded
+		if c.critical {
+			result.Status = StatusDown
+		}
+	}
+	return result
+}
+
+//失败的检查及其错误，例如 "string_instances: no instances"
+func (report *Report) Output() string {
+	var failed []string
+	for name, result := range report.Checks {
+		if result.Status != StatusUp {
+			failed = append(failed, name+": "+result.Error)
+		}
+	}
+	sort.Strings(failed)
+	return strings.Join(failed, "; ")
+}
+
+//按就绪检查的结果返回注册中心的健康状态，用于ttl检查的心跳：
+//up和degraded为passing（与/health/ready的状态码一致，degraded的失败检查记录在说明中），down为critical
+func (h *Health) DiscoveryStatus(ctx context.Context) (status, output string) {
+	report := h.Ready(ctx)
+	if report.Status == StatusDown {
+		return discover.HealthCritical, report.Output()
+	}
+	return discover.HealthPassing, report.Output()
+}
@@ -0,0 +1,124 @@
+package health
+
+import (
+	"Hystrix/common/discover"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var errCheck = errors.New("dependency unavailable")
+
+//检查结果固定的Checker
+func result(err error) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		return err
+	})
+}
+
+//一直阻塞到ctx结束的Checker
+var blocked = CheckerFunc(func(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+})
+
+func TestHealthStatus(t *testing.T) {
+	type readiness struct {
+		checker  Checker
+		critical bool
+	}
+	tests := []struct {
+		name      string
+		liveness  []Checker
+		readiness []readiness
+		live      string
+		ready     string
+		discovery string
+	}{
+		{"no checks", nil, nil, StatusUp, StatusUp, discover.HealthPassing},
+		{"all up", []Checker{result(nil)}, []readiness{{result(nil), true}, {result(nil), false}}, StatusUp, StatusUp, discover.HealthPassing},
+		{"non-critical readiness down", nil, []readiness{{result(nil), true}, {result(errCheck), false}}, StatusUp, StatusDegraded, discover.HealthPassing},
+		{"critical readiness down", nil, []readiness{{result(errCheck), true}, {result(errCheck), false}}, StatusUp, StatusDown, discover.HealthCritical},
+		{"liveness down", []Checker{result(errCheck)}, []readiness{{result(nil), true}}, StatusDown, StatusDown, discover.HealthCritical},
+		{"timeout", nil, []readiness{{blocked, true}}, StatusUp, StatusDown, discover.HealthCritical},
+	}
+	for _, test := range tests {
+		h := New(50 * time.Millisecond)
+		for i, checker := range test.liveness {
+			h.AddLiveness("live-"+string(rune('a'+i)), checker)
+		}
+		for i, r := range test.readiness {
+			h.AddReadiness("ready-"+string(rune('a'+i)), r.checker, r.critical)
+		}
+		ctx := context.Background()
+		if report := h.Live(ctx); report.Status != test.live {
+			t.Errorf("%s: live %s, want %s", test.name, report.Status, test.live)
+		}
+		report := h.Ready(ctx)
+		if report.Status != test.ready {
+			t.Errorf("%s: ready %s, want %s", test.name, report.Status, test.ready)
+		}
+		if len(report.Checks) != len(test.liveness)+len(test.readiness) {
+			t.Errorf("%s: ready ran %d checks, want liveness and readiness checks", test.name, len(report.Checks))
+		}
+		status, output := h.DiscoveryStatus(ctx)
+		if status != test.discovery {
+			t.Errorf("%s: discovery status %s, want %s", test.name, status, test.discovery)
+		}
+		if (output == "") != (test.ready == StatusUp) {
+			t.Errorf("%s: discovery output %q", test.name, output)
+		}
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	h := New(50 * time.Millisecond)
+	h.AddReadiness("b", result(errCheck), false)
+	h.AddReadiness("a", blocked, true)
+	h.AddReadiness("c", result(nil), true)
+	want := "a: " + ErrTimeout.Error() + "; b: " + errCheck.Error()
+	if got := h.Ready(context.Background()).Output(); got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		checker  Checker
+		critical bool
+		status   int
+		report   string
+	}{
+		{"up", result(nil), true, http.StatusOK, StatusUp},
+		{"degraded", result(errCheck), false, http.StatusOK, StatusDegraded},
+		{"down", result(errCheck), true, http.StatusServiceUnavailable, StatusDown},
+	}
+	for _, test := range tests {
+		h := New(0)
+		h.AddReadiness("dependency", test.checker, test.critical)
+		rec := httptest.NewRecorder()
+		h.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, PathReady, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.status)
+		}
+		var report Report
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if report.Status != test.report || report.Checks["dependency"].Critical != test.critical {
+			t.Errorf("%s: report %+v", test.name, report)
+		}
+
+		//就绪检查不影响存活检查
+		rec = httptest.NewRecorder()
+		h.LiveHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, PathLive, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: live status %d, want 200", test.name, rec.Code)
+		}
+	}
+}
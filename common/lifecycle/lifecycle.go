@@ -0,0 +1,181 @@
+package lifecycle
+
+import (
+	"Hystrix/common/health"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//优雅退出参数的默认值
+const (
+	DefaultPropagationDelay = 5 * time.Second
+	DefaultShutdownTimeout  = 15 * time.Second
+	//注销实例的超时
+	deregisterTimeout = 5 * time.Second
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+//服务的启动和优雅退出：
+//收到SIGINT/SIGTERM或任意一个http.Server异常退出后，依次
+//1. 从注册中心注销实例
+//2. 就绪检查变为失败
+//3. 等待PropagationDelay，使注册中心和调用方的缓存感知实例下线
+//4. 断开StreamHandler包装的长连接，调用http.Server.Shutdown，等待处理中的请求完成，最多等待ShutdownTimeout
+//5. 按注册的相反顺序执行停止函数，例如停止hystrix监控和服务发现的订阅
+type Lifecycle struct {
+	//注销后等待调用方感知的时间
+	PropagationDelay time.Duration
+	//等待处理中的请求完成的最长时间
+	ShutdownTimeout time.Duration
+
+	logger *log.Logger
+	//已开始退出，及就绪检查是否已变为失败
+	stopping     int32
+	shuttingDown int32
+
+	mutex      sync.Mutex
+	servers    []*http.Server
+	deregister []func(ctx context.Context) error
+	stops      []func()
+
+	errC chan error
+	//开始等待处理中的请求完成时关闭，通知推送接口断开长连接
+	drainC chan struct{}
+}
+
+//healthz不为nil时注册一个关键的就绪检查，开始退出后返回ErrShuttingDown
+func New(propagationDelay, shutdownTimeout time.Duration, healthz *health.Health, logger *log.Logger) *Lifecycle {
+	l := &Lifecycle{
+		PropagationDelay: propagationDelay,
+		ShutdownTimeout:  shutdownTimeout,
+		logger:           logger,
+		errC:             make(chan error, 1),
+		drainC:           make(chan struct{}),
+	}
+	if healthz != nil {
+		healthz.AddReadiness("shutdown", health.CheckerFunc(func(ctx context.Context) error {
+			if l.ShuttingDown() {
+				return ErrShuttingDown
+			}
+			return nil
+		}), true)
+	}
+	return l
+}
+
+//就绪检查是否已变为失败
+func (l *Lifecycle) ShuttingDown() bool {
+	return atomic.LoadInt32(&l.shuttingDown) == 1
+}
+
+//退出时首先执行，用于从注册中心注销实例
+func (l *Lifecycle) OnDeregister(fn func(ctx context.Context) error) {
+	l.mutex.Lock()
+	l.deregister = append(l.deregister, fn)
+	l.mutex.Unlock()
+}
+
+//所有http.Server退出后执行，按注册的相反顺序
+func (l *Lifecycle) OnStop(fn func()) {
+	l.mutex.Lock()
+	l.stops = append(l.stops, fn)
+	l.mutex.Unlock()
+}
+
+//在后台启动server，异常退出时触发退出流程，已开始退出时不再启动
+func (l *Lifecycle) Serve(server *http.Server) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if atomic.LoadInt32(&l.stopping) == 1 {
+		return
+	}
+	l.servers = append(l.servers, server)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			l.fail(err)
+		}
+	}()
+}
+
+func (l *Lifecycle) fail(err error) {
+	select {
+	case l.errC <- err:
+	default:
+	}
+}
+
+//阻塞直到收到退出信号或某个server异常退出，然后执行退出流程，返回退出的原因
+func (l *Lifecycle) Run() error {
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalC)
+
+	var reason error
+	select {
+	case sig := <-signalC:
+		reason = fmt.Errorf("%s", sig)
+	case reason = <-l.errC:
+	}
+	l.logger.Println("shutting down:", reason)
+	l.Shutdown()
+	return reason
+}
+
+//执行退出流程
+func (l *Lifecycle) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&l.stopping, 0, 1) {
+		return
+	}
+	l.mutex.Lock()
+	servers := l.servers
+	deregister := l.deregister
+	stops := l.stops
+	l.mutex.Unlock()
+
+	//注销实例
+	for _, fn := range deregister {
+		ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+		if err := fn(ctx); err != nil {
+			l.logger.Println("deregister error:", err)
+		}
+		cancel()
+	}
+	//就绪检查变为失败，仍在使用缓存的调用方和负载均衡器通过/health/ready感知
+	atomic.StoreInt32(&l.shuttingDown, 1)
+	//等待注册中心和调用方感知实例下线，期间仍然正常处理请求
+	if l.PropagationDelay > 0 && len(servers) > 0 {
+		l.logger.Println("waiting", l.PropagationDelay, "for deregistration to propagate")
+		time.Sleep(l.PropagationDelay)
+	}
+
+	//等待处理中的请求完成，推送接口的长连接不会自行结束，先通知其断开
+	close(l.drainC)
+	ctx, cancel := context.WithTimeout(context.Background(), l.ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				l.logger.Println("shutdown server", server.Addr, "error:", err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	for i := len(stops) - 1; i >= 0; i-- {
+		stops[i]()
+	}
+}
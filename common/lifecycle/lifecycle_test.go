@@ -0,0 +1,141 @@
+package lifecycle
+
+import (
+	"Hystrix/common/health"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+//按顺序记录退出流程中的事件
+type events struct {
+	mutex sync.Mutex
+	list  []string
+}
+
+func (e *events) add(event string) {
+	e.mutex.Lock()
+	e.list = append(e.list, event)
+	e.mutex.Unlock()
+}
+
+func (e *events) String() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	s := ""
+	for i, event := range e.list {
+		if i > 0 {
+			s += ","
+		}
+		s += event
+	}
+	return s
+}
+
+//空闲的本地地址
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestShutdownOrder(t *testing.T) {
+	healthz := health.New(time.Second)
+	l := New(50*time.Millisecond, 5*time.Second, healthz, log.New(ioutil.Discard, "", 0))
+	ready := func() string {
+		return healthz.Ready(context.Background()).Status
+	}
+	var e events
+
+	//推送接口在开始等待处理中的请求时断开
+	streaming := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/stream", l.StreamHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.(http.Flusher).Flush()
+		close(streaming)
+		<-rw.(http.CloseNotifier).CloseNotify()
+		e.add("drain:" + ready())
+	})))
+	addr := freeAddr(t)
+	server := &http.Server{Addr: addr, Handler: mux}
+	l.Serve(server)
+	l.OnDeregister(func(ctx context.Context) error {
+		e.add("deregister:" + ready())
+		return nil
+	})
+	l.OnStop(func() { e.add("stop-1") })
+	l.OnStop(func() { e.add("stop-2") })
+
+	var resp *http.Response
+	var err error
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get("http://" + addr + "/stream"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	<-streaming
+
+	start := time.Now()
+	l.Shutdown()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v, the stream connection was not closed", elapsed)
+	}
+	want := "deregister:up,drain:down,stop-2,stop-1"
+	if got := e.String(); got != want {
+		t.Errorf("events %s, want %s", got, want)
+	}
+	if !l.ShuttingDown() {
+		t.Error("ShuttingDown() = false after shutdown")
+	}
+	if _, err := http.Get("http://" + addr + "/stream"); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+
+	//重复调用不再执行
+	l.Shutdown()
+	if got := e.String(); got != want {
+		t.Errorf("events %s after a second shutdown, want %s", got, want)
+	}
+}
+
+func TestRunStopsWhenServerFails(t *testing.T) {
+	l := New(0, time.Second, nil, log.New(ioutil.Discard, "", 0))
+	stopped := false
+	l.OnStop(func() { stopped = true })
+	//地址已被占用，ListenAndServe失败后触发退出流程
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	l.Serve(&http.Server{Addr: listener.Addr().String()})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Run()
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Run returned no reason")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the server failed")
+	}
+	if !stopped {
+		t.Error("stop functions did not run")
+	}
+}
@@ -0,0 +1,38 @@
+package lifecycle
+
+import (
+	"net/http"
+)
+
+//包装长连接的推送接口（例如hystrix.StreamHandler），开始等待处理中的请求完成时通知其断开连接，
+//否则http.Server.Shutdown会一直等待到ShutdownTimeout
+//handler需要通过http.CloseNotifier感知连接断开
+func (l *Lifecycle) StreamHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		closeC := make(chan bool, 1)
+		go func() {
+			//连接断开或handler返回后请求的ctx结束
+			select {
+			case <-req.Context().Done():
+			case <-l.drainC:
+			}
+			closeC <- true
+		}()
+		handler.ServeHTTP(&streamWriter{ResponseWriter: rw, closeC: closeC}, req)
+	})
+}
+
+type streamWriter struct {
+	http.ResponseWriter
+	closeC chan bool
+}
+
+func (w *streamWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *streamWriter) CloseNotify() <-chan bool {
+	return w.closeC
+}
@@ -0,0 +1,177 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//每个单位权重在哈希环上的默认虚拟节点数
+const defaultReplicas = 160
+
+//支持按key选取实例的负载均衡器，相同的key总是选取相同的实例
+type KeyedLoadBalance interface {
+	LoadBalance
+	SelectServiceByKey(serviceName string, services []*discover.ServiceInstance, key string) (*discover.ServiceInstance, DoneFunc, error)
+}
+
+//按key选取实例，key为空或负载均衡器不支持按key选取时使用Select
+func SelectByKey(lb LoadBalance, serviceName string, services []*discover.ServiceInstance, key string) (*discover.ServiceInstance, DoneFunc, error) {
+	if klb, ok := lb.(KeyedLoadBalance); ok && key != "" {
+		return klb.SelectServiceByKey(serviceName, services, key)
+	}
+	return Select(lb, serviceName, services)
+}
+
+//哈希环
+type hashRing struct {
+	//实例列表的签名，实例列表变化时重建哈希环
+	signature string
+	hashes    []uint32
+	services  []*discover.ServiceInstance
+	//构建哈希环的实例ID
+	ids map[string]bool
+}
+
+//一致性哈希负载均衡：调用方提供key（例如请求头、cookie或用户ID），相同key的请求落在相同实例上
+//实例上下线时只有哈希环上相邻区间的key会重新映射；哈希环按服务名缓存，
+//通过Rebuild推送实例变化时重建，选取时出现哈希环中没有的实例也会重建；
+//传入的实例是哈希环的子集时（例如部分实例被摘除）顺时针跳过不在列表中的实例，其他key的映射不变
+type ConsistentHashLoadBalance struct {
+	//每个单位权重的虚拟节点数，为0时使用160
+	Replicas int
+
+	mutex sync.RWMutex
+	rings map[string]*hashRing
+}
+
+//没有key时随机选取实例
+func (lb *ConsistentHashLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	if len(services) == 0 {
+		return nil, ErrNoInstance
+	}
+	return services[rand.Intn(len(services))], nil
+}
+
+func (lb *ConsistentHashLoadBalance) SelectServiceByKey(serviceName string, services []*discover.ServiceInstance, key string) (*discover.ServiceInstance, DoneFunc, error) {
+	if len(services) == 0 {
+		return nil, nil, ErrNoInstance
+	}
+	//返回传入列表中的实例，哈希环中的实例地址可能已经过期
+	candidates := make(map[string]*discover.ServiceInstance, len(services))
+	for _, service := range services {
+		candidates[service.ID] = service
+	}
+	ring := lb.ring(serviceName, services, candidates)
+	hash := crc32.ChecksumIEEE([]byte(key))
+	//顺时针找到第一个不小于key哈希值且在传入列表中的虚拟节点
+	i := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	for n := 0; n < len(ring.hashes); n++ {
+		if service, ok := candidates[ring.services[(i+n)%len(ring.hashes)].ID]; ok {
+			return service, noopDone, nil
+		}
+	}
+	return nil, nil, ErrNoInstance
+}
+
+//实例列表变化时重建服务的哈希环
+func (lb *ConsistentHashLoadBalance) Rebuild(serviceName string, services []*discover.ServiceInstance) {
+	if len(services) == 0 {
+		lb.mutex.Lock()
+		delete(lb.rings, serviceName)
+		lb.mutex.Unlock()
+		return
+	}
+	signature := ringSignature(services)
+	lb.mutex.RLock()
+	ring, ok := lb.rings[serviceName]
+	lb.mutex.RUnlock()
+	if ok && ring.signature == signature {
+		return
+	}
+	lb.store(serviceName, lb.buildRing(services, signature))
+}
+
+//获取服务的哈希环，传入的实例不都在哈希环中时使用传入的实例重建
+func (lb *ConsistentHashLoadBalance) ring(serviceName string, services []*discover.ServiceInstance, candidates map[string]*discover.ServiceInstance) *hashRing {
+	lb.mutex.RLock()
+	ring, ok := lb.rings[serviceName]
+	lb.mutex.RUnlock()
+	if ok {
+		complete := true
+		for id := range candidates {
+			if !ring.ids[id] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return ring
+		}
+	}
+
+	ring = lb.buildRing(services, ringSignature(services))
+	lb.store(serviceName, ring)
+	return ring
+}
+
+func (lb *ConsistentHashLoadBalance) store(serviceName string, ring *hashRing) {
+	lb.mutex.Lock()
+	if lb.rings == nil {
+		lb.rings = make(map[string]*hashRing)
+	}
+	lb.rings[serviceName] = ring
+	lb.mutex.Unlock()
+}
+
+func (lb *ConsistentHashLoadBalance) buildRing(services []*discover.ServiceInstance, signature string) *hashRing {
+	replicas := lb.Replicas
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	ring := &hashRing{signature: signature, ids: make(map[string]bool, len(services))}
+	for _, service := range services {
+		ring.ids[service.ID] = true
+		//虚拟节点数按实例权重放大
+		for i := 0; i < replicas*instanceWeight(service); i++ {
+			hash := crc32.ChecksumIEEE([]byte(service.ID + "#" + strconv.Itoa(i)))
+			ring.hashes = append(ring.hashes, hash)
+			ring.services = append(ring.services, service)
+		}
+	}
+	sort.Sort(ring)
+	return ring
+}
+
+func (r *hashRing) Len() int {
+	return len(r.hashes)
+}
+
+func (r *hashRing) Less(i, j int) bool {
+	//哈希值相同时按实例ID排序，保证与实例列表顺序无关
+	if r.hashes[i] == r.hashes[j] {
+		return r.services[i].ID < r.services[j].ID
+	}
+	return r.hashes[i] < r.hashes[j]
+}
+
+func (r *hashRing) Swap(i, j int) {
+	r.hashes[i], r.hashes[j] = r.hashes[j], r.hashes[i]
+	r.services[i], r.services[j] = r.services[j], r.services[i]
+}
+
+//实例列表签名：与顺序无关，包含影响哈希环和转发地址的字段
+func ringSignature(services []*discover.ServiceInstance) string {
+	parts := make([]string, len(services))
+	for i, service := range services {
+		parts[i] = service.ID + "@" + service.Address() + "*" + strconv.Itoa(instanceWeight(service))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,106 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"strconv"
+	"testing"
+)
+
+//按key选取实例，返回每个key选中的实例ID
+func keyMapping(t *testing.T, lb LoadBalance, serviceName string, services []*discover.ServiceInstance, keys int) map[string]string {
+	mapping := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := "user-" + strconv.Itoa(i)
+		instance, _, err := SelectByKey(lb, serviceName, services, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapping[key] = instance.ID
+	}
+	return mapping
+}
+
+func TestConsistentHashRemapping(t *testing.T) {
+	tests := []struct {
+		name string
+		//返回变化后的实例列表，removed为不再可用的实例
+		change  func(services []*discover.ServiceInstance) []*discover.ServiceInstance
+		removed string
+		rebuild bool
+		//其他实例的key最多重新映射的数量
+		maxMoved int
+	}{
+		{"reordered instances", func(s []*discover.ServiceInstance) []*discover.ServiceInstance {
+			return []*discover.ServiceInstance{s[3], s[1], s[0], s[2]}
+		}, "", false, 0},
+		{"instance removed by rebuild", func(s []*discover.ServiceInstance) []*discover.ServiceInstance {
+			return []*discover.ServiceInstance{s[0], s[2], s[3]}
+		}, "b", true, 0},
+		{"instance filtered out without rebuild", func(s []*discover.ServiceInstance) []*discover.ServiceInstance {
+			return []*discover.ServiceInstance{s[0], s[1], s[3]}
+		}, "c", false, 0},
+		//新增实例只接管约1/5的key
+		{"instance added", func(s []*discover.ServiceInstance) []*discover.ServiceInstance {
+			return append(s, testInstances("e")[0])
+		}, "", false, 300},
+	}
+	for _, test := range tests {
+		lb := &ConsistentHashLoadBalance{}
+		services := testInstances("a", "b", "c", "d")
+		before := keyMapping(t, lb, "string", services, 1000)
+		changed := test.change(services)
+		if test.rebuild {
+			lb.Rebuild("string", changed)
+		}
+		after := keyMapping(t, lb, "string", changed, 1000)
+
+		moved := 0
+		for key, id := range before {
+			switch {
+			case id == test.removed && after[key] == id:
+				t.Errorf("%s: %s still mapped to the removed instance", test.name, key)
+			case id != test.removed && after[key] != id:
+				moved++
+			}
+		}
+		if moved > test.maxMoved {
+			t.Errorf("%s: %d/1000 keys of unchanged instances were remapped, want at most %d", test.name, moved, test.maxMoved)
+		}
+	}
+}
+
+func TestConsistentHashWeights(t *testing.T) {
+	lb := &ConsistentHashLoadBalance{}
+	counts := make(map[string]int)
+	for _, id := range keyMapping(t, lb, "string", weightedInstances(3, 1), 4000) {
+		counts[id]++
+	}
+	if counts["a"] < 2*counts["b"] {
+		t.Errorf("counts %v, want a with weight 3 to get about 3 times the keys of b", counts)
+	}
+}
+
+func TestConsistentHashReturnsCurrentInstance(t *testing.T) {
+	lb := &ConsistentHashLoadBalance{}
+	services := testInstances("a")
+	lb.Rebuild("string", services)
+
+	//实例地址变化后返回传入列表中的实例
+	moved := testInstances("a")
+	moved[0].Port = 9000
+	instance, _, err := SelectByKey(lb, "string", moved, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Port != 9000 {
+		t.Errorf("selected port %d, want the current port 9000", instance.Port)
+	}
+
+	if _, _, err := SelectByKey(lb, "string", nil, "user-1"); err != ErrNoInstance {
+		t.Errorf("selecting from no instances returned %v, want ErrNoInstance", err)
+	}
+	//没有key时随机选取
+	if _, _, err := SelectByKey(lb, "string", services, ""); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,96 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//请求完成时反馈给负载均衡器的信息
+type DoneInfo struct {
+	//请求执行异常，为nil表示成功
+	Err error
+	//请求耗时
+	Duration time.Duration
+}
+
+//请求完成回调，每次选取实例后必须调用且只调用一次
+type DoneFunc func(info DoneInfo)
+
+//需要感知请求完成的负载均衡器，调用方在请求结束时通过DoneFunc反馈结果和耗时
+//serviceName为调用方查询实例时使用的服务名（可以带查询参数），与Rebuild的serviceName一致，按服务维护状态时作为key
+type TrackingLoadBalance interface {
+	LoadBalance
+	SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error)
+}
+
+func noopDone(DoneInfo) {}
+
+//使用负载均衡器选取serviceName的实例，负载均衡器不需要感知请求完成时返回空操作的DoneFunc
+func Select(lb LoadBalance, serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	if tlb, ok := lb.(TrackingLoadBalance); ok {
+		return tlb.SelectServiceWithDone(serviceName, services)
+	}
+	service, err := lb.SelectService(services)
+	return service, noopDone, err
+}
+
+//最少未完成请求负载均衡：按实例ID记录正在处理的请求数，选取请求数最少的实例，数量相同时随机选取
+type LeastRequestLoadBalance struct {
+	mutex sync.Mutex
+	//只记录正在处理请求的实例，请求数归零后删除
+	inflight map[string]int
+}
+
+//选取实例但不记录请求，应使用Select或SelectServiceWithDone
+func (lb *LeastRequestLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.selectLocked(services)
+}
+
+func (lb *LeastRequestLoadBalance) SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	selected, err := lb.selectLocked(services)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lb.inflight == nil {
+		lb.inflight = make(map[string]int)
+	}
+	id := selected.ID
+	lb.inflight[id]++
+
+	var once sync.Once
+	return selected, func(DoneInfo) {
+		once.Do(func() {
+			lb.mutex.Lock()
+			defer lb.mutex.Unlock()
+			if lb.inflight[id] <= 1 {
+				delete(lb.inflight, id)
+			} else {
+				lb.inflight[id]--
+			}
+		})
+	}, nil
+}
+
+func (lb *LeastRequestLoadBalance) selectLocked(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	if len(services) == 0 {
+		return nil, ErrNoInstance
+	}
+	//从随机位置开始遍历，请求数相同时随机选取
+	offset := rand.Intn(len(services))
+	var selected *discover.ServiceInstance
+	least := 0
+	for i := range services {
+		service := services[(offset+i)%len(services)]
+		if n := lb.inflight[service.ID]; selected == nil || n < least {
+			selected = service
+			least = n
+		}
+	}
+	return selected, nil
+}
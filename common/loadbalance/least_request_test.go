@@ -0,0 +1,88 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"testing"
+)
+
+//在实例上保持正在处理的请求，返回结束这些请求的函数
+func holdRequests(t *testing.T, lb LoadBalance, services []*discover.ServiceInstance, inflight map[string]int) func() {
+	var dones []DoneFunc
+	for id, n := range inflight {
+		for _, service := range services {
+			if service.ID != id {
+				continue
+			}
+			for i := 0; i < n; i++ {
+				_, done, err := Select(lb, "string", []*discover.ServiceInstance{service})
+				if err != nil {
+					t.Fatal(err)
+				}
+				dones = append(dones, done)
+			}
+		}
+	}
+	return func() {
+		for _, done := range dones {
+			done(DoneInfo{})
+		}
+	}
+}
+
+func TestLeastRequestSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		inflight map[string]int
+		want     []string
+	}{
+		{"no requests", nil, []string{"a", "b", "c"}},
+		{"one busy instance", map[string]int{"a": 1}, []string{"b", "c"}},
+		{"least busy instance", map[string]int{"a": 3, "b": 1, "c": 2}, []string{"b"}},
+		{"ties between least busy", map[string]int{"a": 2, "b": 1, "c": 1}, []string{"b", "c"}},
+	}
+	for _, test := range tests {
+		lb := &LeastRequestLoadBalance{}
+		services := testInstances("a", "b", "c")
+		release := holdRequests(t, lb, services, test.inflight)
+		counts := countSelections(t, 300, func() (*discover.ServiceInstance, DoneFunc, error) {
+			return Select(lb, "string", services)
+		})
+		for _, id := range test.want {
+			if counts[id] == 0 {
+				t.Errorf("%s: %s was never selected, counts %v", test.name, id, counts)
+			}
+			delete(counts, id)
+		}
+		if len(counts) > 0 {
+			t.Errorf("%s: selected busier instances %v", test.name, counts)
+		}
+		release()
+	}
+}
+
+func TestLeastRequestDone(t *testing.T) {
+	lb := &LeastRequestLoadBalance{}
+	services := testInstances("a", "b")
+	_, doneA, _ := Select(lb, "string", services[:1])
+	_, doneB, _ := Select(lb, "string", services[1:])
+	_, doneB2, _ := Select(lb, "string", services[1:])
+
+	//重复调用DoneFunc只结束一次请求
+	doneB(DoneInfo{})
+	doneB(DoneInfo{})
+	counts := countSelections(t, 100, func() (*discover.ServiceInstance, DoneFunc, error) {
+		return Select(lb, "string", services)
+	})
+	if counts["a"] == 0 || counts["b"] == 0 {
+		t.Errorf("a and b both have one request but counts are %v", counts)
+	}
+
+	doneA(DoneInfo{})
+	if id := selectSequence(t, lb, "string", services, 1); id != "a" {
+		t.Errorf("selected %s, want a after its request finished", id)
+	}
+	doneB2(DoneInfo{})
+	if len(lb.inflight) != 0 {
+		t.Errorf("inflight %v after all requests finished, want empty", lb.inflight)
+	}
+}
@@ -1,14 +1,15 @@
 package loadbalance
 
 import (
+	"Hystrix/common/discover"
 	"errors"
-	"github.com/hashicorp/consul/api"
 	"math/rand"
+	"sync"
 )
 
 //负载均衡器
 type LoadBalance interface {
-	SelectService(service []*api.AgentService) (*api.AgentService, error)
+	SelectService(service []*discover.ServiceInstance) (*discover.ServiceInstance, error)
 }
 
 type RandomLoadBalance struct {
@@ -16,13 +17,121 @@ type RandomLoadBalance struct {
 
 var ErrNoInstance = errors.New("service instance are not existed")
 
+//负载均衡策略
+const (
+	StrategyRandom           = "random"
+	StrategyWeightRoundRobin = "weight-round-robin"
+	StrategyLeastRequest     = "least-request"
+	StrategyP2C              = "p2c-ewma"
+	StrategyConsistentHash   = "consistent-hash"
+)
+
+var ErrUnknownStrategy = errors.New("unknown load balance strategy")
+
+//根据策略名称创建负载均衡器
+func NewLoadBalance(strategy string) (LoadBalance, error) {
+	switch strategy {
+	case StrategyRandom:
+		return &RandomLoadBalance{}, nil
+	case StrategyWeightRoundRobin:
+		return &WeightRoundRobinLoadBalance{}, nil
+	case StrategyLeastRequest:
+		return &LeastRequestLoadBalance{}, nil
+	case StrategyP2C:
+		return &P2CLoadBalance{}, nil
+	case StrategyConsistentHash:
+		return &ConsistentHashLoadBalance{}, nil
+	}
+	return nil, ErrUnknownStrategy
+}
+
 //随机负载均衡
-func (rb *RandomLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+func (rb *RandomLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
 	if services == nil || len(services) == 0 {
 		return nil, ErrNoInstance
 	}
 	return services[rand.Intn(len(services))], nil
 }
 
+//平滑加权轮询负载均衡（与nginx相同的算法）
+//每次选择时所有实例的当前权重加上各自的权重，选出当前权重最大的实例，再将其当前权重减去总权重
+//当前权重按服务名（与Rebuild和Select的serviceName一致）分别记录，新实例从0开始；已下线实例的记录在Rebuild时清理，
+//未使用Rebuild时记录数超过实例数两倍后按当前列表重建
 type WeightRoundRobinLoadBalance struct {
+	mutex          sync.Mutex
+	currentWeights map[string]map[string]int
+}
+
+//不经过Select调用时按实例的服务名记录当前权重
+func (wb *WeightRoundRobinLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	return wb.selectService(serviceNameOf(services), services)
+}
+
+func (wb *WeightRoundRobinLoadBalance) SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	service, err := wb.selectService(serviceName, services)
+	return service, noopDone, err
+}
+
+func (wb *WeightRoundRobinLoadBalance) selectService(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	if len(services) == 0 {
+		return nil, ErrNoInstance
+	}
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	if wb.currentWeights == nil {
+		wb.currentWeights = make(map[string]map[string]int)
+	}
+
+	current := wb.currentWeights[serviceName]
+	if current == nil || len(current) > 2*len(services) {
+		last := current
+		current = make(map[string]int, len(services))
+		for _, service := range services {
+			current[service.ID] = last[service.ID]
+		}
+		wb.currentWeights[serviceName] = current
+	}
+	total := 0
+	var selected *discover.ServiceInstance
+	for _, service := range services {
+		weight := instanceWeight(service)
+		total += weight
+		current[service.ID] += weight
+		if selected == nil || current[service.ID] > current[selected.ID] {
+			selected = service
+		}
+	}
+	current[selected.ID] -= total
+	return selected, nil
+}
+
+//清理已下线实例的当前权重
+func (wb *WeightRoundRobinLoadBalance) Rebuild(serviceName string, services []*discover.ServiceInstance) {
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	last, ok := wb.currentWeights[serviceName]
+	if !ok {
+		return
+	}
+	current := make(map[string]int, len(services))
+	for _, service := range services {
+		current[service.ID] = last[service.ID]
+	}
+	wb.currentWeights[serviceName] = current
+}
+
+//实例所属的服务名，用于不经过Select直接调用SelectService时
+func serviceNameOf(services []*discover.ServiceInstance) string {
+	if len(services) == 0 {
+		return ""
+	}
+	return services[0].Name
+}
+
+//实例权重，未设置时为1
+func instanceWeight(service *discover.ServiceInstance) int {
+	if service.Weight > 0 {
+		return service.Weight
+	}
+	return 1
 }
@@ -0,0 +1,90 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"strings"
+	"testing"
+)
+
+//按权重创建实例，权重依次对应a、b、c...
+func weightedInstances(weights ...int) []*discover.ServiceInstance {
+	ids := make([]string, len(weights))
+	for i := range weights {
+		ids[i] = string(rune('a' + i))
+	}
+	instances := testInstances(ids...)
+	for i, weight := range weights {
+		instances[i].Weight = weight
+	}
+	return instances
+}
+
+//连续选取n次，返回选中的实例ID序列
+func selectSequence(t *testing.T, lb LoadBalance, serviceName string, services []*discover.ServiceInstance, n int) string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		instance, done, err := Select(lb, serviceName, services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(DoneInfo{})
+		ids = append(ids, instance.ID)
+	}
+	return strings.Join(ids, "")
+}
+
+func TestWeightRoundRobinSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    string
+	}{
+		{"nginx example", []int{5, 1, 1}, "aabacaa"},
+		{"equal weights", []int{1, 1, 1}, "abcabc"},
+		{"unset weight counts as 1", []int{0, 2}, "babbab"},
+		{"single instance", []int{3}, "aaa"},
+	}
+	for _, test := range tests {
+		lb := &WeightRoundRobinLoadBalance{}
+		if got := selectSequence(t, lb, "string", weightedInstances(test.weights...), len(test.want)); got != test.want {
+			t.Errorf("%s: selected %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWeightRoundRobinKeepsWeightsPerService(t *testing.T) {
+	lb := &WeightRoundRobinLoadBalance{}
+	services := weightedInstances(2, 1)
+	if got := selectSequence(t, lb, "string", services, 2); got != "ab" {
+		t.Fatalf("selected %s, want ab", got)
+	}
+	//其他服务名（例如带查询参数）的当前权重单独记录
+	if got := selectSequence(t, lb, "string?tag=primary", services, 3); got != "aba" {
+		t.Errorf("selected %s for another service name, want aba", got)
+	}
+	if got := selectSequence(t, lb, "string", services, 1); got != "a" {
+		t.Errorf("selected %s, want the sequence of string to continue with a", got)
+	}
+
+	//Rebuild保留仍在线实例的当前权重，新实例从0开始
+	lb.Rebuild("string", weightedInstances(2, 1, 1))
+	if got := selectSequence(t, lb, "string", weightedInstances(2, 1, 1), 4); got != "abca" {
+		t.Errorf("selected %s after rebuild, want abca", got)
+	}
+}
+
+func TestNewLoadBalance(t *testing.T) {
+	for _, strategy := range []string{StrategyRandom, StrategyWeightRoundRobin, StrategyLeastRequest, StrategyP2C, StrategyConsistentHash} {
+		lb, err := NewLoadBalance(strategy)
+		if err != nil {
+			t.Errorf("%s: %v", strategy, err)
+			continue
+		}
+		if _, err := lb.SelectService(nil); err != ErrNoInstance {
+			t.Errorf("%s: selecting from no instances returned %v, want ErrNoInstance", strategy, err)
+		}
+	}
+	if _, err := NewLoadBalance("round-robin"); err != ErrUnknownStrategy {
+		t.Errorf("unknown strategy returned %v, want ErrUnknownStrategy", err)
+	}
+}
@@ -0,0 +1,230 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"sync"
+	"time"
+)
+
+//异常实例检测配置
+type OutlierConfig struct {
+	//连续失败次数达到该值时摘除实例，为0时不按连续失败摘除
+	ConsecutiveFailures int
+	//统计窗口内错误率达到该百分比时摘除实例，为0时不按错误率摘除
+	ErrorPercent int
+	//按错误率摘除要求统计窗口内的最少请求数
+	MinRequests int
+	//错误率统计窗口
+	Interval time.Duration
+	//第n次摘除的时长为 BaseEjectionTime * 2^(n-1)，不超过MaxEjectionTime
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	//同一服务最多摘除的实例百分比
+	MaxEjectionPercent int
+}
+
+var DefaultOutlierConfig = OutlierConfig{
+	ConsecutiveFailures: 5,
+	ErrorPercent:        50,
+	MinRequests:         10,
+	Interval:            10 * time.Second,
+	BaseEjectionTime:    30 * time.Second,
+	MaxEjectionTime:     5 * time.Minute,
+	MaxEjectionPercent:  50,
+}
+
+//单个实例的统计信息
+type outlierStats struct {
+	//连续失败次数
+	consecutiveFailures int
+	//当前统计窗口的请求数和失败数
+	windowStart time.Time
+	requests    int
+	failures    int
+	//摘除次数、摘除截止时间
+	ejections    int
+	ejectedUntil time.Time
+}
+
+//被动异常检测：根据调用方反馈的请求结果按服务名（与Rebuild和Select的serviceName一致）和实例ID统计连续失败次数和错误率，
+//异常实例在摘除时间内不参与选取，多次摘除时摘除时间指数增长；
+//同一服务被摘除的实例比例不超过MaxEjectionPercent，所有实例都被摘除时仍使用全部实例
+//实际的选取由Next完成，调用方需要通过DoneFunc反馈请求结果
+type OutlierLoadBalance struct {
+	Config OutlierConfig
+	Next   LoadBalance
+
+	mutex     sync.Mutex
+	stats     map[string]map[string]*outlierStats
+	lastPrune time.Time
+}
+
+func NewOutlierLoadBalance(config OutlierConfig, next LoadBalance) *OutlierLoadBalance {
+	return &OutlierLoadBalance{
+		Config: config,
+		Next:   next,
+		stats:  make(map[string]map[string]*outlierStats),
+	}
+}
+
+//选取实例但不统计请求结果，应使用Select或SelectServiceWithDone；按实例的服务名查找摘除的实例
+func (lb *OutlierLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	return lb.Next.SelectService(lb.filter(serviceNameOf(services), services))
+}
+
+func (lb *OutlierLoadBalance) SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	service, done, err := Select(lb.Next, serviceName, lb.filter(serviceName, services))
+	return lb.track(serviceName, services, service, done, err)
+}
+
+func (lb *OutlierLoadBalance) SelectServiceByKey(serviceName string, services []*discover.ServiceInstance, key string) (*discover.ServiceInstance, DoneFunc, error) {
+	service, done, err := SelectByKey(lb.Next, serviceName, lb.filter(serviceName, services), key)
+	return lb.track(serviceName, services, service, done, err)
+}
+
+//清理已下线实例的统计
+func (lb *OutlierLoadBalance) Rebuild(serviceName string, services []*discover.ServiceInstance) {
+	ids := make(map[string]bool, len(services))
+	for _, service := range services {
+		ids[service.ID] = true
+	}
+	lb.mutex.Lock()
+	for id := range lb.stats[serviceName] {
+		if !ids[id] {
+			delete(lb.stats[serviceName], id)
+		}
+	}
+	if len(lb.stats[serviceName]) == 0 {
+		delete(lb.stats, serviceName)
+	}
+	lb.mutex.Unlock()
+	Rebuild(lb.Next, serviceName, services)
+}
+
+//包装DoneFunc，请求结束时统计结果
+func (lb *OutlierLoadBalance) track(serviceName string, services []*discover.ServiceInstance, service *discover.ServiceInstance, done DoneFunc, err error) (*discover.ServiceInstance, DoneFunc, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	total := len(services)
+	return service, func(info DoneInfo) {
+		lb.report(serviceName, service, total, info.Err)
+		done(info)
+	}, nil
+}
+
+//去掉摘除中的实例
+func (lb *OutlierLoadBalance) filter(serviceName string, services []*discover.ServiceInstance) []*discover.ServiceInstance {
+	now := time.Now()
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.pruneLocked(now)
+	serviceStats := lb.stats[serviceName]
+	var filtered []*discover.ServiceInstance
+	for i, service := range services {
+		if stats, ok := serviceStats[service.ID]; ok && now.Before(stats.ejectedUntil) {
+			if filtered == nil {
+				filtered = append(make([]*discover.ServiceInstance, 0, len(services)), services[:i]...)
+			}
+			continue
+		}
+		if filtered != nil {
+			filtered = append(filtered, service)
+		}
+	}
+	if len(filtered) == 0 {
+		return services
+	}
+	return filtered
+}
+
+//统计请求结果，达到阀值时摘除实例
+func (lb *OutlierLoadBalance) report(serviceName string, service *discover.ServiceInstance, total int, err error) {
+	now := time.Now()
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.stats == nil {
+		lb.stats = make(map[string]map[string]*outlierStats)
+	}
+	serviceStats := lb.stats[serviceName]
+	if serviceStats == nil {
+		serviceStats = make(map[string]*outlierStats)
+		lb.stats[serviceName] = serviceStats
+	}
+	stats, ok := serviceStats[service.ID]
+	if !ok {
+		stats = &outlierStats{windowStart: now}
+		serviceStats[service.ID] = stats
+	}
+	if now.Sub(stats.windowStart) > lb.Config.Interval {
+		stats.windowStart = now
+		stats.requests = 0
+		stats.failures = 0
+	}
+	stats.requests++
+	if err == nil {
+		stats.consecutiveFailures = 0
+		return
+	}
+	stats.failures++
+	stats.consecutiveFailures++
+
+	if now.Before(stats.ejectedUntil) {
+		return
+	}
+	consecutive := lb.Config.ConsecutiveFailures > 0 && stats.consecutiveFailures >= lb.Config.ConsecutiveFailures
+	errorRate := lb.Config.ErrorPercent > 0 && stats.requests >= lb.Config.MinRequests &&
+		stats.failures*100 >= lb.Config.ErrorPercent*stats.requests
+	if (consecutive || errorRate) && lb.canEjectLocked(serviceStats, total, now) {
+		lb.ejectLocked(stats, now)
+	}
+}
+
+//摘除后不超过最大摘除比例时返回true
+func (lb *OutlierLoadBalance) canEjectLocked(serviceStats map[string]*outlierStats, total int, now time.Time) bool {
+	ejected := 1
+	for _, stats := range serviceStats {
+		if now.Before(stats.ejectedUntil) {
+			ejected++
+		}
+	}
+	return ejected*100 <= lb.Config.MaxEjectionPercent*total
+}
+
+func (lb *OutlierLoadBalance) ejectLocked(stats *outlierStats, now time.Time) {
+	//距离上次摘除结束已超过最大摘除时间，重新计算摘除次数
+	if now.Sub(stats.ejectedUntil) > lb.Config.MaxEjectionTime {
+		stats.ejections = 0
+	}
+	stats.ejections++
+	ejection := lb.Config.BaseEjectionTime
+	for i := 1; i < stats.ejections && ejection < lb.Config.MaxEjectionTime; i++ {
+		ejection *= 2
+	}
+	if ejection > lb.Config.MaxEjectionTime {
+		ejection = lb.Config.MaxEjectionTime
+	}
+	stats.ejectedUntil = now.Add(ejection)
+	stats.consecutiveFailures = 0
+	stats.windowStart = now
+	stats.requests = 0
+	stats.failures = 0
+}
+
+//清理长时间没有请求且未被摘除的实例统计，避免已下线实例的统计一直保留
+func (lb *OutlierLoadBalance) pruneLocked(now time.Time) {
+	if now.Sub(lb.lastPrune) < statsIdleTimeout {
+		return
+	}
+	lb.lastPrune = now
+	for serviceName, serviceStats := range lb.stats {
+		for id, stats := range serviceStats {
+			if now.Sub(stats.windowStart) > statsIdleTimeout+lb.Config.Interval && now.Sub(stats.ejectedUntil) > lb.Config.MaxEjectionTime {
+				delete(serviceStats, id)
+			}
+		}
+		if len(serviceStats) == 0 {
+			delete(lb.stats, serviceName)
+		}
+	}
+}
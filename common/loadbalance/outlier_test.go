@@ -0,0 +1,105 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"errors"
+	"testing"
+	"time"
+)
+
+//总是选取第一个实例，用于确定请求结果反馈到哪个实例
+type firstLoadBalance struct{}
+
+func (firstLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	if len(services) == 0 {
+		return nil, ErrNoInstance
+	}
+	return services[0], nil
+}
+
+var errUpstream = errors.New("upstream error")
+
+//选取一次并反馈请求结果，返回被选中的实例ID
+func selectAndReport(t *testing.T, lb LoadBalance, serviceName string, services []*discover.ServiceInstance, err error) string {
+	instance, done, selectErr := Select(lb, serviceName, services)
+	if selectErr != nil {
+		t.Fatal(selectErr)
+	}
+	done(DoneInfo{Err: err})
+	return instance.ID
+}
+
+func TestOutlierEjection(t *testing.T) {
+	ejection := OutlierConfig{BaseEjectionTime: time.Minute, MaxEjectionTime: time.Hour, MaxEjectionPercent: 50, Interval: time.Minute}
+	withConfig := func(change func(*OutlierConfig)) OutlierConfig {
+		config := ejection
+		change(&config)
+		return config
+	}
+	tests := []struct {
+		name    string
+		config  OutlierConfig
+		results []error
+		ejected bool
+	}{
+		{"consecutive failures", withConfig(func(c *OutlierConfig) { c.ConsecutiveFailures = 3 }),
+			[]error{errUpstream, errUpstream, errUpstream}, true},
+		{"success resets consecutive failures", withConfig(func(c *OutlierConfig) { c.ConsecutiveFailures = 3 }),
+			[]error{errUpstream, errUpstream, nil, errUpstream, errUpstream}, false},
+		{"error percent", withConfig(func(c *OutlierConfig) { c.ErrorPercent = 50; c.MinRequests = 4 }),
+			[]error{nil, errUpstream, nil, errUpstream}, true},
+		{"error percent below min requests", withConfig(func(c *OutlierConfig) { c.ErrorPercent = 50; c.MinRequests = 10 }),
+			[]error{errUpstream, errUpstream, errUpstream}, false},
+		{"error percent below threshold", withConfig(func(c *OutlierConfig) { c.ErrorPercent = 50; c.MinRequests = 4 }),
+			[]error{nil, errUpstream, nil, nil}, false},
+		{"max ejection percent", withConfig(func(c *OutlierConfig) { c.ConsecutiveFailures = 1; c.MaxEjectionPercent = 20 }),
+			[]error{errUpstream}, false},
+	}
+	for _, test := range tests {
+		lb := NewOutlierLoadBalance(test.config, firstLoadBalance{})
+		services := testInstances("a", "b", "c", "d")
+		for _, err := range test.results {
+			selectAndReport(t, lb, "string", services, err)
+		}
+		ejected := selectAndReport(t, lb, "string", services, nil) != "a"
+		if ejected != test.ejected {
+			t.Errorf("%s: ejected = %v, want %v", test.name, ejected, test.ejected)
+		}
+	}
+}
+
+func TestOutlierUsesAllInstancesWhenAllEjected(t *testing.T) {
+	lb := NewOutlierLoadBalance(OutlierConfig{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute, MaxEjectionTime: time.Hour, MaxEjectionPercent: 100}, firstLoadBalance{})
+	services := testInstances("a", "b")
+	if id := selectAndReport(t, lb, "string", services, errUpstream); id != "a" {
+		t.Fatalf("selected %s, want a", id)
+	}
+	if id := selectAndReport(t, lb, "string", services, errUpstream); id != "b" {
+		t.Fatalf("selected %s after a was ejected, want b", id)
+	}
+	if id := selectAndReport(t, lb, "string", services, nil); id != "a" {
+		t.Errorf("selected %s with all instances ejected, want a from the full list", id)
+	}
+}
+
+func TestOutlierRebuildWithServiceQuery(t *testing.T) {
+	const serviceName = "string?tag=primary"
+	lb := NewOutlierLoadBalance(OutlierConfig{ConsecutiveFailures: 1, BaseEjectionTime: time.Minute, MaxEjectionTime: time.Hour, MaxEjectionPercent: 50}, firstLoadBalance{})
+	services := testInstances("a", "b", "c", "d")
+	selectAndReport(t, lb, serviceName, services, errUpstream)
+	if id := selectAndReport(t, lb, serviceName, services, nil); id == "a" {
+		t.Fatal("a was not ejected")
+	}
+
+	//实例列表不变时保留摘除状态
+	lb.Rebuild(serviceName, services)
+	if id := selectAndReport(t, lb, serviceName, services, nil); id == "a" {
+		t.Fatal("rebuild with the same instances cleared the ejection")
+	}
+	//a下线后重新上线，按新实例统计
+	lb.Rebuild(serviceName, services[1:])
+	lb.Rebuild(serviceName, services)
+	if id := selectAndReport(t, lb, serviceName, services, nil); id != "a" {
+		t.Errorf("selected %s, want a to start with fresh stats after it went away", id)
+	}
+}
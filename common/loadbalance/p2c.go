@@ -0,0 +1,175 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	//EWMA的默认衰减时间常数
+	defaultDecay = 10 * time.Second
+	//失败请求按不低于该值的耗时计入EWMA
+	defaultFailurePenalty = time.Second
+	//超过该时间没有请求的实例统计被清理
+	statsIdleTimeout = time.Minute
+)
+
+//单个实例的统计信息
+type p2cStats struct {
+	//请求耗时的指数加权移动平均值，单位纳秒
+	ewma     float64
+	inflight int
+	updated  time.Time
+	//是否已有耗时样本，第一个样本直接作为EWMA
+	sampled bool
+}
+
+//随机选取两个实例，选择 EWMA耗时 × (正在处理的请求数+1) 较小的实例
+//请求完成时需要通过DoneFunc反馈耗时和结果，失败的请求按FailurePenalty计入耗时
+//还没有耗时样本的实例（例如新上线的实例）按候选实例中已有样本的EWMA平均值计算，避免所有请求都涌向新实例
+type P2CLoadBalance struct {
+	//EWMA的衰减时间常数，为0时使用10s
+	Decay time.Duration
+	//失败请求的最低耗时，为0时使用1s
+	FailurePenalty time.Duration
+
+	mutex     sync.Mutex
+	stats     map[string]*p2cStats
+	lastPrune time.Time
+}
+
+//选取实例但不记录请求，应使用Select或SelectServiceWithDone
+func (lb *P2CLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.selectLocked(services, time.Now())
+}
+
+func (lb *P2CLoadBalance) SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	now := time.Now()
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	selected, err := lb.selectLocked(services, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats := lb.statsLocked(selected.ID, now)
+	stats.inflight++
+
+	var once sync.Once
+	return selected, func(info DoneInfo) {
+		once.Do(func() {
+			lb.done(stats, info)
+		})
+	}, nil
+}
+
+func (lb *P2CLoadBalance) done(stats *p2cStats, info DoneInfo) {
+	duration := info.Duration
+	if penalty := lb.failurePenalty(); info.Err != nil && duration < penalty {
+		duration = penalty
+	}
+	now := time.Now()
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	stats.inflight--
+	if stats.sampled {
+		//按距离上次更新的时间衰减，长时间没有请求时新的耗时权重更大
+		w := math.Exp(-float64(now.Sub(stats.updated)) / float64(lb.decay()))
+		stats.ewma = stats.ewma*w + float64(duration)*(1-w)
+	} else {
+		stats.ewma = float64(duration)
+		stats.sampled = true
+	}
+	stats.updated = now
+}
+
+func (lb *P2CLoadBalance) selectLocked(services []*discover.ServiceInstance, now time.Time) (*discover.ServiceInstance, error) {
+	switch len(services) {
+	case 0:
+		return nil, ErrNoInstance
+	case 1:
+		return services[0], nil
+	}
+	lb.pruneLocked(now)
+	i := rand.Intn(len(services))
+	j := rand.Intn(len(services) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := services[i], services[j]
+	initial := lb.averageEWMALocked(services)
+	if lb.costLocked(b.ID, initial) < lb.costLocked(a.ID, initial) {
+		return b, nil
+	}
+	return a, nil
+}
+
+//实例的负载：EWMA耗时 × (正在处理的请求数+1)，没有耗时样本时EWMA为initial，EWMA加1避免耗时为0时忽略请求数
+func (lb *P2CLoadBalance) costLocked(id string, initial float64) float64 {
+	ewma, inflight := initial, 0
+	if stats, ok := lb.stats[id]; ok {
+		inflight = stats.inflight
+		if stats.sampled {
+			ewma = stats.ewma
+		}
+	}
+	return (ewma + 1) * float64(inflight+1)
+}
+
+//实例中已有耗时样本的EWMA平均值，都没有样本时为0
+func (lb *P2CLoadBalance) averageEWMALocked(services []*discover.ServiceInstance) float64 {
+	total, n := 0.0, 0
+	for _, service := range services {
+		if stats, ok := lb.stats[service.ID]; ok && stats.sampled {
+			total += stats.ewma
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float64(n)
+}
+
+func (lb *P2CLoadBalance) statsLocked(id string, now time.Time) *p2cStats {
+	if lb.stats == nil {
+		lb.stats = make(map[string]*p2cStats)
+	}
+	stats, ok := lb.stats[id]
+	if !ok {
+		stats = &p2cStats{updated: now}
+		lb.stats[id] = stats
+	}
+	return stats
+}
+
+//清理长时间没有请求的实例统计，避免已下线实例的统计一直保留
+func (lb *P2CLoadBalance) pruneLocked(now time.Time) {
+	if now.Sub(lb.lastPrune) < statsIdleTimeout {
+		return
+	}
+	lb.lastPrune = now
+	for id, stats := range lb.stats {
+		if stats.inflight == 0 && now.Sub(stats.updated) > statsIdleTimeout {
+			delete(lb.stats, id)
+		}
+	}
+}
+
+func (lb *P2CLoadBalance) decay() time.Duration {
+	if lb.Decay > 0 {
+		return lb.Decay
+	}
+	return defaultDecay
+}
+
+func (lb *P2CLoadBalance) failurePenalty() time.Duration {
+	if lb.FailurePenalty > 0 {
+		return lb.FailurePenalty
+	}
+	return defaultFailurePenalty
+}
@@ -0,0 +1,71 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"testing"
+	"time"
+)
+
+//p2c中实例的请求结果
+type p2cSample struct {
+	id       string
+	duration time.Duration
+	err      error
+}
+
+func TestP2CSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []p2cSample
+		inflight map[string]int
+		want     string
+	}{
+		{"lower latency", []p2cSample{{"a", 100 * time.Millisecond, nil}, {"b", 10 * time.Millisecond, nil}}, nil, "b"},
+		{"inflight requests", []p2cSample{{"a", 10 * time.Millisecond, nil}, {"b", 20 * time.Millisecond, nil}}, map[string]int{"a": 3}, "b"},
+		{"failure penalty", []p2cSample{{"a", time.Millisecond, errUpstream}, {"b", 100 * time.Millisecond, nil}}, nil, "b"},
+		{"unsampled instance uses the average", []p2cSample{{"a", 50 * time.Millisecond, nil}}, map[string]int{"a": 1}, "b"},
+	}
+	for _, test := range tests {
+		lb := &P2CLoadBalance{}
+		services := testInstances("a", "b")
+		for _, sample := range test.samples {
+			for _, service := range services {
+				if service.ID == sample.id {
+					_, done, _ := Select(lb, "string", []*discover.ServiceInstance{service})
+					done(DoneInfo{Duration: sample.duration, Err: sample.err})
+				}
+			}
+		}
+		release := holdRequests(t, lb, services, test.inflight)
+		//只有两个实例时每次都比较这两个实例
+		counts := countSelections(t, 50, func() (*discover.ServiceInstance, DoneFunc, error) {
+			return Select(lb, "string", services)
+		})
+		if counts[test.want] != 50 {
+			t.Errorf("%s: counts %v, want always %s", test.name, counts, test.want)
+		}
+		release()
+	}
+}
+
+func TestP2CDoesNotFloodUnsampledInstances(t *testing.T) {
+	lb := &P2CLoadBalance{}
+	services := testInstances("a", "b", "c")
+	for i, duration := range []time.Duration{10 * time.Millisecond, 100 * time.Millisecond} {
+		_, done, _ := Select(lb, "string", services[i:i+1])
+		done(DoneInfo{Duration: duration})
+	}
+
+	//c按a、b的平均耗时计算，只在与b比较时被选中
+	counts := make(map[string]int)
+	for i := 0; i < 900; i++ {
+		instance, err := lb.SelectService(services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[instance.ID]++
+	}
+	if counts["b"] != 0 || counts["c"] == 0 || counts["c"] >= counts["a"] {
+		t.Errorf("counts %v, want a preferred over the new instance c and b never selected", counts)
+	}
+}
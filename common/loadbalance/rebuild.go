@@ -0,0 +1,30 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+)
+
+//实例列表变化时重建内部状态（哈希环、权重表等）的负载均衡器，
+//选取时不必再按每次传入的实例列表检查变化
+type RebuildLoadBalance interface {
+	LoadBalance
+	Rebuild(serviceName string, services []*discover.ServiceInstance)
+}
+
+//负载均衡器支持重建时通知其实例列表变化
+func Rebuild(lb LoadBalance, serviceName string, services []*discover.ServiceInstance) {
+	if rlb, ok := lb.(RebuildLoadBalance); ok {
+		rlb.Rebuild(serviceName, services)
+	}
+}
+
+//订阅服务的实例变化并重建负载均衡器，返回取消订阅的函数
+func RebuildOnChange(watcher discover.Watcher, lb LoadBalance, serviceName string) func() {
+	instancesC, cancel := watcher.Watch(serviceName)
+	go func() {
+		for services := range instancesC {
+			Rebuild(lb, serviceName, services)
+		}
+	}()
+	return cancel
+}
@@ -0,0 +1,83 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"strings"
+	"testing"
+	"time"
+)
+
+//记录Rebuild收到的实例列表
+type recordingLoadBalance struct {
+	RandomLoadBalance
+	rebuilds chan string
+}
+
+func (lb *recordingLoadBalance) Rebuild(serviceName string, services []*discover.ServiceInstance) {
+	ids := make([]string, len(services))
+	for i, service := range services {
+		ids[i] = service.ID
+	}
+	lb.rebuilds <- serviceName + ":" + strings.Join(ids, ",")
+}
+
+//由测试推送实例列表的Watcher
+type channelWatcher struct {
+	serviceName string
+	instancesC  chan []*discover.ServiceInstance
+	canceled    chan struct{}
+}
+
+func (w *channelWatcher) Watch(serviceName string) (<-chan []*discover.ServiceInstance, func()) {
+	w.serviceName = serviceName
+	return w.instancesC, func() {
+		close(w.canceled)
+		close(w.instancesC)
+	}
+}
+
+func TestRebuildOnChange(t *testing.T) {
+	watcher := &channelWatcher{instancesC: make(chan []*discover.ServiceInstance), canceled: make(chan struct{})}
+	lb := &recordingLoadBalance{rebuilds: make(chan string, 1)}
+	cancel := RebuildOnChange(watcher, lb, "string?tag=primary")
+	if watcher.serviceName != "string?tag=primary" {
+		t.Fatalf("watched %q, want the service name with its query", watcher.serviceName)
+	}
+
+	tests := []struct {
+		services []*discover.ServiceInstance
+		want     string
+	}{
+		{testInstances("a"), "string?tag=primary:a"},
+		{testInstances("a", "b"), "string?tag=primary:a,b"},
+		{nil, "string?tag=primary:"},
+	}
+	for _, test := range tests {
+		watcher.instancesC <- test.services
+		select {
+		case got := <-lb.rebuilds:
+			if got != test.want {
+				t.Errorf("rebuilt %q, want %q", got, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no rebuild for %q", test.want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-watcher.canceled:
+	default:
+		t.Error("cancel did not cancel the subscription")
+	}
+}
+
+func TestRebuildIgnoresPlainLoadBalance(t *testing.T) {
+	//不支持重建的负载均衡器直接忽略
+	Rebuild(&RandomLoadBalance{}, "string", testInstances("a"))
+	lb := &ConsistentHashLoadBalance{}
+	Rebuild(lb, "string", testInstances("a"))
+	if _, ok := lb.rings["string"]; !ok {
+		t.Error("rebuild did not build the hash ring")
+	}
+}
@@ -0,0 +1,117 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//慢启动：新出现的实例在预热窗口内有效权重从0线性增长到完整权重，避免缓存未预热的实例被流量打满
+//实例首次出现在服务实例列表中的时间作为预热起点，第一次看到某个服务时已存在的实例视为已预热；
+//选取时预热中的实例按 (1 - 已预热时间/预热窗口) 的概率被排除，实际的选取由Next完成
+//按key选取时不做预热，保证相同key始终落在相同实例上
+//选取时传入的实例可能已被其他负载均衡器或断路器筛选过，不在列表中的实例保留首次出现的时间，
+//只有Rebuild（完整的实例列表）才会移除已下线的实例
+type SlowStartLoadBalance struct {
+	//预热窗口
+	Window time.Duration
+	Next   LoadBalance
+
+	mutex sync.Mutex
+	//按服务名（与Rebuild和Select的serviceName一致）记录实例首次出现的时间
+	firstSeen map[string]map[string]time.Time
+}
+
+func NewSlowStartLoadBalance(window time.Duration, next LoadBalance) *SlowStartLoadBalance {
+	return &SlowStartLoadBalance{
+		Window: window,
+		Next:   next,
+	}
+}
+
+func (lb *SlowStartLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	return lb.Next.SelectService(lb.filter(serviceNameOf(services), services))
+}
+
+func (lb *SlowStartLoadBalance) SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	return Select(lb.Next, serviceName, lb.filter(serviceName, services))
+}
+
+func (lb *SlowStartLoadBalance) SelectServiceByKey(serviceName string, services []*discover.ServiceInstance, key string) (*discover.ServiceInstance, DoneFunc, error) {
+	lb.warmupFactors(serviceName, services, false)
+	return SelectByKey(lb.Next, serviceName, services, key)
+}
+
+//实例列表变化时记录新实例出现的时间，预热从实例上线开始而不是从第一次请求开始
+func (lb *SlowStartLoadBalance) Rebuild(serviceName string, services []*discover.ServiceInstance) {
+	if len(services) == 0 {
+		//所有实例下线，之后重新上线的实例需要预热
+		lb.mutex.Lock()
+		if _, ok := lb.firstSeen[serviceName]; ok {
+			lb.firstSeen[serviceName] = map[string]time.Time{}
+		}
+		lb.mutex.Unlock()
+	}
+	lb.warmupFactors(serviceName, services, true)
+	Rebuild(lb.Next, serviceName, services)
+}
+
+//按预热进度随机排除预热中的实例，全部被排除时返回原列表
+func (lb *SlowStartLoadBalance) filter(serviceName string, services []*discover.ServiceInstance) []*discover.ServiceInstance {
+	factors := lb.warmupFactors(serviceName, services, false)
+	if factors == nil {
+		return services
+	}
+	filtered := make([]*discover.ServiceInstance, 0, len(services))
+	for i, service := range services {
+		if factors[i] >= 1 || rand.Float64() < factors[i] {
+			filtered = append(filtered, service)
+		}
+	}
+	if len(filtered) == 0 {
+		return services
+	}
+	return filtered
+}
+
+//更新实例首次出现的时间并计算各实例的预热进度，没有实例在预热中时返回nil
+//rebuild为true时services是完整的实例列表，移除不在其中的实例
+func (lb *SlowStartLoadBalance) warmupFactors(serviceName string, services []*discover.ServiceInstance, rebuild bool) []float64 {
+	if len(services) == 0 || lb.Window <= 0 {
+		return nil
+	}
+	now := time.Now()
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if lb.firstSeen == nil {
+		lb.firstSeen = make(map[string]map[string]time.Time)
+	}
+	last, known := lb.firstSeen[serviceName]
+	current := last
+	if rebuild || current == nil {
+		current = make(map[string]time.Time, len(services))
+	}
+	var factors []float64
+	for i, service := range services {
+		seen, ok := last[service.ID]
+		if !ok && known {
+			//新出现的实例，第一次看到该服务时的实例使用零值时间，视为已预热
+			seen = now
+		}
+		current[service.ID] = seen
+		if elapsed := now.Sub(seen); elapsed < lb.Window {
+			if factors == nil {
+				factors = make([]float64, len(services))
+				for j := range factors {
+					factors[j] = 1
+				}
+			}
+			factors[i] = float64(elapsed) / float64(lb.Window)
+		}
+	}
+	//重建时只保留当前列表中的实例，下线后重新上线的实例需要重新预热
+	lb.firstSeen[serviceName] = current
+	return factors
+}
@@ -0,0 +1,110 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"testing"
+	"time"
+)
+
+func testInstances(ids ...string) []*discover.ServiceInstance {
+	instances := make([]*discover.ServiceInstance, len(ids))
+	for i, id := range ids {
+		instances[i] = &discover.ServiceInstance{ID: id, Name: "string", Host: "127.0.0.1", Port: 8000 + i, Weight: 1, Health: discover.HealthPassing}
+	}
+	return instances
+}
+
+//选取n次，返回各实例被选中的次数
+func countSelections(t *testing.T, n int, selectFn func() (*discover.ServiceInstance, DoneFunc, error)) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		instance, done, err := selectFn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(DoneInfo{})
+		counts[instance.ID]++
+	}
+	return counts
+}
+
+func TestSlowStartKeepsFilteredInstancesWarm(t *testing.T) {
+	lb := NewSlowStartLoadBalance(time.Hour, &RandomLoadBalance{})
+	all := testInstances("a", "b")
+	//第一次看到服务时已存在的实例视为已预热
+	lb.Rebuild("string", all)
+
+	//b被上游的筛选（例如异常摘除、断路器）暂时排除
+	for i := 0; i < 10; i++ {
+		Select(lb, "string", all[:1])
+	}
+
+	counts := countSelections(t, 1000, func() (*discover.ServiceInstance, DoneFunc, error) {
+		return Select(lb, "string", all)
+	})
+	if counts["b"] < 300 {
+		t.Errorf("b selected %d/1000 times after being filtered out, want it to stay warm", counts["b"])
+	}
+}
+
+func TestSlowStartWarmup(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		//依次推送的实例列表
+		rebuilds [][]string
+		cold     []string
+	}{
+		{"initial instances are warm", time.Hour, [][]string{{"a", "b"}}, nil},
+		{"new instance is cold", time.Hour, [][]string{{"a"}, {"a", "b"}}, []string{"b"}},
+		{"returning instance is cold again", time.Hour, [][]string{{"a", "b"}, {"a"}, {"a", "b"}}, []string{"b"}},
+		{"instances after all went away are cold", time.Hour, [][]string{{"a"}, nil, {"a"}, {"a", "b"}}, []string{"a", "b"}},
+		{"zero window", 0, [][]string{{"a"}, {"a", "b"}}, nil},
+	}
+	for _, test := range tests {
+		lb := NewSlowStartLoadBalance(test.window, &RandomLoadBalance{})
+		var services []*discover.ServiceInstance
+		for _, ids := range test.rebuilds {
+			services = testInstances(ids...)
+			lb.Rebuild("string", services)
+		}
+		counts := countSelections(t, 200, func() (*discover.ServiceInstance, DoneFunc, error) {
+			return Select(lb, "string", services)
+		})
+		cold := make(map[string]bool)
+		for _, id := range test.cold {
+			cold[id] = true
+		}
+		//全部实例都在预热中时使用全部实例
+		allCold := len(test.cold) == len(services)
+		for _, service := range services {
+			if selected := counts[service.ID] > 0; selected == cold[service.ID] && !allCold {
+				t.Errorf("%s: %s selected %d/200 times, cold = %v", test.name, service.ID, counts[service.ID], cold[service.ID])
+			}
+		}
+		if allCold && len(counts) != len(services) {
+			t.Errorf("%s: counts %v, want all instances used when all are cold", test.name, counts)
+		}
+	}
+}
+
+func TestSlowStartKeyedSelectionIgnoresWarmup(t *testing.T) {
+	lb := NewSlowStartLoadBalance(time.Hour, &ConsistentHashLoadBalance{})
+	lb.Rebuild("string", testInstances("a"))
+	services := testInstances("a", "b")
+	lb.Rebuild("string", services)
+
+	mapping := keyMapping(t, lb, "string", services, 100)
+	for key, id := range keyMapping(t, lb, "string", services, 100) {
+		if mapping[key] != id {
+			t.Errorf("%s selected %s and %s", key, mapping[key], id)
+		}
+	}
+	counts := make(map[string]int)
+	for _, id := range mapping {
+		counts[id]++
+	}
+	if counts["b"] == 0 {
+		t.Error("keys are not mapped to the warming instance b")
+	}
+}
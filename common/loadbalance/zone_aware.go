@@ -0,0 +1,68 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+)
+
+//实例元数据中可用区的默认key
+const DefaultZoneKey = "zone"
+
+//可用区感知负载均衡：优先选取与调用方相同可用区的实例，
+//本地可用区健康实例的总权重低于MinLocalCapacity时，其他可用区的实例也参与选取
+//实际的选取由Next完成
+type ZoneAwareLoadBalance struct {
+	//调用方所在的可用区，为空时不区分可用区
+	Zone string
+	//实例元数据中可用区的key，为空时使用zone
+	ZoneKey string
+	//本地可用区的最低容量（实例权重之和），为0时只要有本地实例就不跨可用区
+	MinLocalCapacity int
+	Next             LoadBalance
+}
+
+func NewZoneAwareLoadBalance(zone string, minLocalCapacity int, next LoadBalance) *ZoneAwareLoadBalance {
+	return &ZoneAwareLoadBalance{
+		Zone:             zone,
+		MinLocalCapacity: minLocalCapacity,
+		Next:             next,
+	}
+}
+
+func (lb *ZoneAwareLoadBalance) SelectService(services []*discover.ServiceInstance) (*discover.ServiceInstance, error) {
+	return lb.Next.SelectService(lb.filter(services))
+}
+
+func (lb *ZoneAwareLoadBalance) SelectServiceWithDone(serviceName string, services []*discover.ServiceInstance) (*discover.ServiceInstance, DoneFunc, error) {
+	return Select(lb.Next, serviceName, lb.filter(services))
+}
+
+func (lb *ZoneAwareLoadBalance) SelectServiceByKey(serviceName string, services []*discover.ServiceInstance, key string) (*discover.ServiceInstance, DoneFunc, error) {
+	return SelectByKey(lb.Next, serviceName, lb.filter(services), key)
+}
+
+func (lb *ZoneAwareLoadBalance) Rebuild(serviceName string, services []*discover.ServiceInstance) {
+	Rebuild(lb.Next, serviceName, services)
+}
+
+//本地可用区容量足够时只保留本地实例，否则返回全部实例
+func (lb *ZoneAwareLoadBalance) filter(services []*discover.ServiceInstance) []*discover.ServiceInstance {
+	if lb.Zone == "" {
+		return services
+	}
+	zoneKey := lb.ZoneKey
+	if zoneKey == "" {
+		zoneKey = DefaultZoneKey
+	}
+	var local []*discover.ServiceInstance
+	capacity := 0
+	for _, service := range services {
+		if service.Meta[zoneKey] == lb.Zone {
+			local = append(local, service)
+			capacity += instanceWeight(service)
+		}
+	}
+	if len(local) == 0 || capacity < lb.MinLocalCapacity {
+		return services
+	}
+	return local
+}
@@ -0,0 +1,89 @@
+package loadbalance
+
+import (
+	"Hystrix/common/discover"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//按可用区创建实例，zones中的每一项为"可用区"或"可用区:权重"
+func zonedInstances(zoneKey string, zones ...string) []*discover.ServiceInstance {
+	weights := make([]int, len(zones))
+	for i := range zones {
+		weights[i] = 1
+	}
+	instances := weightedInstances(weights...)
+	for i, zone := range zones {
+		parts := strings.SplitN(zone, ":", 2)
+		if len(parts) == 2 {
+			instances[i].Weight, _ = strconv.Atoi(parts[1])
+		}
+		instances[i].Meta = map[string]string{zoneKey: parts[0]}
+	}
+	return instances
+}
+
+func TestZoneAwareSelection(t *testing.T) {
+	tests := []struct {
+		name        string
+		zone        string
+		zoneKey     string
+		minCapacity int
+		zones       []string
+		want        string
+	}{
+		{"no zone", "", "", 0, []string{"z1", "z2"}, "ab"},
+		{"local instances only", "z1", "", 0, []string{"z1", "z2", "z1"}, "ac"},
+		{"no local instances", "z3", "", 0, []string{"z1", "z2"}, "ab"},
+		{"local capacity too low", "z1", "", 2, []string{"z1", "z2", "z2"}, "abc"},
+		{"local capacity counts weights", "z1", "", 2, []string{"z1:2", "z2"}, "a"},
+		{"custom zone key", "z2", "az", 0, []string{"z1", "z2"}, "b"},
+	}
+	for _, test := range tests {
+		lb := NewZoneAwareLoadBalance(test.zone, test.minCapacity, &RandomLoadBalance{})
+		lb.ZoneKey = test.zoneKey
+		zoneKey := test.zoneKey
+		if zoneKey == "" {
+			zoneKey = DefaultZoneKey
+		}
+		services := zonedInstances(zoneKey, test.zones...)
+		counts := countSelections(t, 200, func() (*discover.ServiceInstance, DoneFunc, error) {
+			return Select(lb, "string", services)
+		})
+		var selected []string
+		for id := range counts {
+			selected = append(selected, id)
+		}
+		sort.Strings(selected)
+		if got := strings.Join(selected, ""); got != test.want {
+			t.Errorf("%s: selected %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestZoneAwareDelegatesToNext(t *testing.T) {
+	next := &ConsistentHashLoadBalance{}
+	lb := NewZoneAwareLoadBalance("z1", 0, next)
+	services := zonedInstances(DefaultZoneKey, "z1", "z2", "z1")
+
+	//Rebuild传入全部实例，选取时只在本地实例中按key映射
+	lb.Rebuild("string", services)
+	if _, ok := next.rings["string"]; !ok {
+		t.Fatal("rebuild was not passed to the next load balancer")
+	}
+	first, _, err := SelectByKey(lb, "string", services, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		instance, _, _ := SelectByKey(lb, "string", services, "user-1")
+		if instance.ID != first.ID {
+			t.Fatalf("key user-1 selected %s and %s", first.ID, instance.ID)
+		}
+	}
+	if first.Meta[DefaultZoneKey] != "z1" {
+		t.Errorf("key user-1 selected %s in zone %s, want a local instance", first.ID, first.Meta[DefaultZoneKey])
+	}
+}
@@ -0,0 +1,230 @@
+package registry
+
+import (
+	"Hystrix/common/discover"
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//实例心跳超时的默认值
+	DefaultTTL = 30 * time.Second
+	//检查心跳超时的默认间隔
+	DefaultReapInterval = time.Second
+)
+
+var ErrInvalidInstance = errors.New("instance id, name, host and port are required")
+
+//注册的实例及其心跳信息
+type entry struct {
+	instance *discover.ServiceInstance
+	ttl      time.Duration
+	expireAt time.Time
+}
+
+//内存中的服务注册表，实例需要在TTL内发送心跳，超时后被移除
+//每次变化时递增索引，用于阻塞查询等待服务实例变化
+type Registry struct {
+	logger *log.Logger
+
+	mutex sync.Mutex
+	//全局索引，从1开始
+	index uint64
+	//按服务名、实例ID保存实例
+	services map[string]map[string]*entry
+	//实例ID所属的服务名
+	serviceNames map[string]string
+	//服务最近一次变化时的索引
+	serviceIndex map[string]uint64
+	//每次变化时关闭并替换，用于唤醒阻塞查询
+	changed chan struct{}
+
+	stopOnce sync.Once
+	stopC    chan struct{}
+}
+
+func NewRegistry(logger *log.Logger) *Registry {
+	return &Registry{
+		logger:       logger,
+		index:        1,
+		services:     make(map[string]map[string]*entry),
+		serviceNames: make(map[string]string),
+		serviceIndex: make(map[string]uint64),
+		changed:      make(chan struct{}),
+		stopC:        make(chan struct{}),
+	}
+}
+
+//注册实例，相同ID的实例被替换；ttl不大于0时使用DefaultTTL
+func (r *Registry) Register(instance *discover.ServiceInstance, ttl time.Duration) error {
+	if instance.ID == "" || instance.Name == "" || instance.Host == "" || instance.Port <= 0 {
+		return ErrInvalidInstance
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	registered := *instance
+	if registered.Weight <= 0 {
+		registered.Weight = 1
+	}
+	registered.Health = discover.HealthPassing
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	//实例ID改为注册到其他服务时，从原服务中移除
+	if name, ok := r.serviceNames[registered.ID]; ok && name != registered.Name {
+		r.removeLocked(name, registered.ID)
+	}
+	if r.services[registered.Name] == nil {
+		r.services[registered.Name] = make(map[string]*entry)
+	}
+	r.services[registered.Name][registered.ID] = &entry{
+		instance: &registered,
+		ttl:      ttl,
+		expireAt: time.Now().Add(ttl),
+	}
+	r.serviceNames[registered.ID] = registered.Name
+	r.changeLocked(registered.Name)
+	return nil
+}
+
+//注销实例，实例不存在时返回false
+func (r *Registry) Deregister(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name, ok := r.serviceNames[id]
+	if !ok {
+		return false
+	}
+	r.removeLocked(name, id)
+	return true
+}
+
+//刷新实例的心跳，实例不存在（未注册或已超时移除）时返回false
+func (r *Registry) Heartbeat(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name, ok := r.serviceNames[id]
+	if !ok {
+		return false
+	}
+	e := r.services[name][id]
+	e.expireAt = time.Now().Add(e.ttl)
+	return true
+}
+
+//服务的实例列表（按ID排序）及当前索引
+func (r *Registry) Instances(name string) ([]*discover.ServiceInstance, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.instancesLocked(name), r.indexLocked(name)
+}
+
+//阻塞直到服务在index之后发生变化或ctx结束，index为0时立即返回
+func (r *Registry) Wait(ctx context.Context, name string, index uint64) ([]*discover.ServiceInstance, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for index != 0 && r.indexLocked(name) <= index {
+		changed := r.changed
+		r.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		r.mutex.Lock()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return r.instancesLocked(name), r.indexLocked(name)
+}
+
+//已注册的服务名
+func (r *Registry) Services() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//在后台按interval移除心跳超时的实例，直到Stop
+func (r *Registry) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReapInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stopC:
+				return
+			case now := <-ticker.C:
+				r.reap(now)
+			}
+		}
+	}()
+}
+
+func (r *Registry) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopC)
+	})
+}
+
+//移除心跳超时的实例
+func (r *Registry) reap(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, entries := range r.services {
+		for id, e := range entries {
+			if now.After(e.expireAt) {
+				r.logger.Println("instance", id, "of service", name, "expired")
+				r.removeLocked(name, id)
+			}
+		}
+	}
+}
+
+func (r *Registry) removeLocked(name, id string) {
+	delete(r.services[name], id)
+	if len(r.services[name]) == 0 {
+		delete(r.services, name)
+	}
+	delete(r.serviceNames, id)
+	r.changeLocked(name)
+}
+
+func (r *Registry) changeLocked(name string) {
+	r.index++
+	r.serviceIndex[name] = r.index
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+//服务的索引，从未注册过的服务使用全局索引
+func (r *Registry) indexLocked(name string) uint64 {
+	if index, ok := r.serviceIndex[name]; ok {
+		return index
+	}
+	return r.index
+}
+
+func (r *Registry) instancesLocked(name string) []*discover.ServiceInstance {
+	instances := make([]*discover.ServiceInstance, 0, len(r.services[name]))
+	for _, e := range r.services[name] {
+		instances = append(instances, e.instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+	return instances
+}
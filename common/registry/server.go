@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"Hystrix/common/discover"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//HTTP API，与discover.RegistryDiscoveryClient对应
+const (
+	PathRegister   = "/v1/register"
+	PathDeregister = "/v1/deregister/"
+	PathHeartbeat  = "/v1/heartbeat/"
+	PathServices   = "/v1/services"
+	//阻塞查询返回的索引
+	IndexHeader = "X-Registry-Index"
+)
+
+const (
+	//阻塞查询的默认和最长等待时间
+	defaultWait = 30 * time.Second
+	maxWait     = 5 * time.Minute
+)
+
+//注册请求，ttl为心跳超时时间，例如 "30s"
+type registration struct {
+	discover.ServiceInstance
+	TTL string `json:"ttl"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+//注册中心的HTTP API：
+//PUT /v1/register                 注册实例，请求体为实例信息和ttl
+//PUT /v1/deregister/<id>          注销实例
+//PUT /v1/heartbeat/<id>           发送心跳，实例不存在时返回404
+//GET /v1/services                 已注册的服务名
+//GET /v1/services/<name>?index=&wait=  服务的实例列表，index不为0时阻塞直到服务变化或超过wait
+func NewHandler(registry *Registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathRegister, func(rw http.ResponseWriter, req *http.Request) {
+		if !checkMethod(rw, req, http.MethodPut) {
+			return
+		}
+		reg := &registration{}
+		if err := json.NewDecoder(req.Body).Decode(reg); err != nil {
+			writeJSON(rw, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		var ttl time.Duration
+		if reg.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(reg.TTL); err != nil {
+				writeJSON(rw, http.StatusBadRequest, errorResponse{Error: err.Error()})
+				return
+			}
+		}
+		if err := registry.Register(&reg.ServiceInstance, ttl); err != nil {
+			writeJSON(rw, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(PathDeregister, func(rw http.ResponseWriter, req *http.Request) {
+		if !checkMethod(rw, req, http.MethodPut) {
+			return
+		}
+		//注销不存在的实例视为成功
+		registry.Deregister(strings.TrimPrefix(req.URL.Path, PathDeregister))
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(PathHeartbeat, func(rw http.ResponseWriter, req *http.Request) {
+		if !checkMethod(rw, req, http.MethodPut) {
+			return
+		}
+		if !registry.Heartbeat(strings.TrimPrefix(req.URL.Path, PathHeartbeat)) {
+			writeJSON(rw, http.StatusNotFound, errorResponse{Error: "instance not registered"})
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(PathServices, func(rw http.ResponseWriter, req *http.Request) {
+		if !checkMethod(rw, req, http.MethodGet) {
+			return
+		}
+		writeJSON(rw, http.StatusOK, registry.Services())
+	})
+	mux.HandleFunc(PathServices+"/", func(rw http.ResponseWriter, req *http.Request) {
+		if !checkMethod(rw, req, http.MethodGet) {
+			return
+		}
+		name := strings.TrimPrefix(req.URL.Path, PathServices+"/")
+		query := req.URL.Query()
+		var index uint64
+		if s := query.Get("index"); s != "" {
+			var err error
+			if index, err = strconv.ParseUint(s, 10, 64); err != nil {
+				writeJSON(rw, http.StatusBadRequest, errorResponse{Error: err.Error()})
+				return
+			}
+		}
+		wait := defaultWait
+		if s := query.Get("wait"); s != "" {
+			var err error
+			if wait, err = time.ParseDuration(s); err != nil {
+				writeJSON(rw, http.StatusBadRequest, errorResponse{Error: err.Error()})
+				return
+			}
+			if wait > maxWait {
+				wait = maxWait
+			}
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), wait)
+		defer cancel()
+		instances, index := registry.Wait(ctx, name, index)
+		rw.Header().Set(IndexHeader, strconv.FormatUint(index, 10))
+		writeJSON(rw, http.StatusOK, instances)
+	})
+	return mux
+}
+
+func checkMethod(rw http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		rw.Header().Set("Allow", method)
+		writeJSON(rw, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return false
+	}
+	return true
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json;charset=utf-8")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,211 @@
+package registry
+
+import (
+	"Hystrix/common/discover"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer() (*Registry, *httptest.Server) {
+	registry := NewRegistry(log.New(ioutil.Discard, "", 0))
+	return registry, httptest.NewServer(NewHandler(registry))
+}
+
+func put(t *testing.T, server *httptest.Server, path, body string) int {
+	req, err := http.NewRequest(http.MethodPut, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func listInstances(t *testing.T, server *httptest.Server, path string) ([]*discover.ServiceInstance, uint64) {
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	var instances []*discover.ServiceInstance
+	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		t.Fatal(err)
+	}
+	index, err := strconv.ParseUint(resp.Header.Get(IndexHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("GET %s: bad index header %q", path, resp.Header.Get(IndexHeader))
+	}
+	return instances, index
+}
+
+func registerBody(id, ttl string) string {
+	return `{"id":"` + id + `","name":"string","host":"127.0.0.1","port":8000,"tags":["primary"],"ttl":"` + ttl + `"}`
+}
+
+func TestRegisterAndList(t *testing.T) {
+	_, server := newTestServer()
+	defer server.Close()
+
+	if status := put(t, server, PathRegister, registerBody("string-1", "30s")); status != http.StatusOK {
+		t.Fatalf("register: status %d", status)
+	}
+
+	resp, err := http.Get(server.URL + PathServices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	json.NewDecoder(resp.Body).Decode(&names)
+	resp.Body.Close()
+	if len(names) != 1 || names[0] != "string" {
+		t.Errorf("services = %v, want [string]", names)
+	}
+
+	instances, _ := listInstances(t, server, PathServices+"/string")
+	if len(instances) != 1 {
+		t.Fatalf("got %d instances, want 1", len(instances))
+	}
+	instance := instances[0]
+	if instance.ID != "string-1" || instance.Address() != "127.0.0.1:8000" || instance.Weight != 1 ||
+		instance.Health != discover.HealthPassing || len(instance.Tags) != 1 || instance.Tags[0] != "primary" {
+		t.Errorf("instance = %+v", *instance)
+	}
+}
+
+func TestRegisterRejectsInvalidRequests(t *testing.T) {
+	_, server := newTestServer()
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing host", `{"id":"string-1","name":"string","port":8000}`},
+		{"bad ttl", `{"id":"string-1","name":"string","host":"127.0.0.1","port":8000,"ttl":"soon"}`},
+		{"bad json", `{`},
+	}
+	for _, test := range tests {
+		if status := put(t, server, PathRegister, test.body); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", test.name, status, http.StatusBadRequest)
+		}
+	}
+
+	resp, err := http.Get(server.URL + PathRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPut {
+		t.Errorf("GET register: status %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestHeartbeatExpiry(t *testing.T) {
+	registry, server := newTestServer()
+	defer server.Close()
+
+	registered := time.Now()
+	put(t, server, PathRegister, registerBody("string-1", "200ms"))
+
+	//心跳在TTL内刷新过期时间
+	time.Sleep(150 * time.Millisecond)
+	if status := put(t, server, PathHeartbeat+"string-1", ""); status != http.StatusOK {
+		t.Fatalf("heartbeat: status %d", status)
+	}
+	registry.reap(registered.Add(300 * time.Millisecond))
+	if instances, _ := listInstances(t, server, PathServices+"/string"); len(instances) != 1 {
+		t.Fatalf("instance expired although heartbeat was sent")
+	}
+
+	//超过TTL没有心跳时被移除，之后的心跳返回404
+	registry.reap(time.Now().Add(2 * time.Second))
+	if instances, _ := listInstances(t, server, PathServices+"/string"); len(instances) != 0 {
+		t.Fatalf("got %d instances after expiry, want 0", len(instances))
+	}
+	if status := put(t, server, PathHeartbeat+"string-1", ""); status != http.StatusNotFound {
+		t.Errorf("heartbeat after expiry: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	_, server := newTestServer()
+	defer server.Close()
+
+	put(t, server, PathRegister, registerBody("string-1", "30s"))
+	put(t, server, PathRegister, registerBody("string-2", "30s"))
+	if status := put(t, server, PathDeregister+"string-1", ""); status != http.StatusOK {
+		t.Fatalf("deregister: status %d", status)
+	}
+	instances, _ := listInstances(t, server, PathServices+"/string")
+	if len(instances) != 1 || instances[0].ID != "string-2" {
+		t.Errorf("instances after deregister = %v", instances)
+	}
+	//注销不存在的实例视为成功
+	if status := put(t, server, PathDeregister+"unknown", ""); status != http.StatusOK {
+		t.Errorf("deregister unknown: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestBlockingQuery(t *testing.T) {
+	_, server := newTestServer()
+	defer server.Close()
+
+	put(t, server, PathRegister, registerBody("string-1", "30s"))
+	_, index := listInstances(t, server, PathServices+"/string")
+
+	//没有变化时等待wait后返回原索引
+	start := time.Now()
+	instances, unchanged := listInstances(t, server, PathServices+"/string?index="+strconv.FormatUint(index, 10)+"&wait=100ms")
+	if unchanged != index || len(instances) != 1 {
+		t.Errorf("timed out query: index %d, %d instances, want index %d and 1 instance", unchanged, len(instances), index)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("timed out query returned after %v, want at least 100ms", elapsed)
+	}
+
+	//服务变化时立即返回
+	type result struct {
+		instances []*discover.ServiceInstance
+		index     uint64
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		instances, index := listInstances(t, server, PathServices+"/string?index="+strconv.FormatUint(index, 10)+"&wait=10s")
+		resultC <- result{instances, index}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	put(t, server, PathRegister, registerBody("string-2", "30s"))
+	select {
+	case r := <-resultC:
+		if r.index <= index || len(r.instances) != 2 {
+			t.Errorf("blocking query: index %d, %d instances, want index > %d and 2 instances", r.index, len(r.instances), index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocking query did not return after the service changed")
+	}
+
+	//其他服务的变化不唤醒阻塞查询
+	_, index = listInstances(t, server, PathServices+"/string")
+	go func() {
+		_, index := listInstances(t, server, PathServices+"/string?index="+strconv.FormatUint(index, 10)+"&wait=200ms")
+		resultC <- result{nil, index}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	put(t, server, PathRegister, `{"id":"other-1","name":"other","host":"127.0.0.1","port":9000}`)
+	if r := <-resultC; r.index != index {
+		t.Errorf("query woken by another service: index %d, want %d", r.index, index)
+	}
+}
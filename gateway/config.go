@@ -0,0 +1,149 @@
+package main
+
+import (
+	"Hystrix/common/discover"
+	"encoding/json"
+	"github.com/afex/hystrix-go/hystrix"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+//网关配置，支持YAML和JSON两种格式
+type GatewayConfig struct {
+	//网关全局的hystrix参数，覆盖命令行参数中的默认值
+	Hystrix *HystrixConfig `json:"hystrix" yaml:"hystrix"`
+	//按服务名配置的hystrix参数
+	Services map[string]*HystrixConfig `json:"services" yaml:"services"`
+	//作为hystrix失败上报的上游响应状态码，例如 ["5xx", "429"]
+	FailureStatus []string `json:"failure_status" yaml:"failure_status"`
+	Routes        []*Route `json:"routes" yaml:"routes"`
+}
+
+//命令行参数提供的网关默认配置，配置文件中未设置时使用
+type Defaults struct {
+	Hystrix       HystrixConfig
+	FailureStatus []string
+	//按 路由名/实例ID 为每个实例维护断路器，所有实例的断路器都打开时才降级
+	PerInstanceCircuit bool
+}
+
+//hystrix命令参数，时间单位为毫秒，为0时表示沿用上一级配置
+type HystrixConfig struct {
+	//超时时间
+	Timeout int `json:"timeout" yaml:"timeout"`
+	//最大并发请求数
+	MaxConcurrentRequests int `json:"max_concurrent_requests" yaml:"max_concurrent_requests"`
+	//最低请求阀值
+	RequestVolumeThreshold int `json:"request_volume_threshold" yaml:"request_volume_threshold"`
+	//断路器打开后进入半开状态的时间窗口
+	SleepWindow int `json:"sleep_window" yaml:"sleep_window"`
+	//错误百分比阀值
+	ErrorPercentThreshold int `json:"error_percent_threshold" yaml:"error_percent_threshold"`
+}
+
+//用override中非0的参数覆盖当前参数
+func (c HystrixConfig) Merge(override *HystrixConfig) HystrixConfig {
+	if override == nil {
+		return c
+	}
+	if override.Timeout != 0 {
+		c.Timeout = override.Timeout
+	}
+	if override.MaxConcurrentRequests != 0 {
+		c.MaxConcurrentRequests = override.MaxConcurrentRequests
+	}
+	if override.RequestVolumeThreshold != 0 {
+		c.RequestVolumeThreshold = override.RequestVolumeThreshold
+	}
+	if override.SleepWindow != 0 {
+		c.SleepWindow = override.SleepWindow
+	}
+	if override.ErrorPercentThreshold != 0 {
+		c.ErrorPercentThreshold = override.ErrorPercentThreshold
+	}
+	return c
+}
+
+func (c HystrixConfig) CommandConfig() hystrix.CommandConfig {
+	return hystrix.CommandConfig{
+		Timeout:                c.Timeout,
+		MaxConcurrentRequests:  c.MaxConcurrentRequests,
+		RequestVolumeThreshold: c.RequestVolumeThreshold,
+		SleepWindow:            c.SleepWindow,
+		ErrorPercentThreshold:  c.ErrorPercentThreshold,
+	}
+}
+
+//计算路由最终使用的hystrix参数
+//优先级：路由配置 > 服务配置 > 配置文件全局配置 > defaults
+//服务配置按服务名查找，不包含路由服务中的查询参数
+func (gc *GatewayConfig) CommandConfig(defaults HystrixConfig, route *Route) hystrix.CommandConfig {
+	serviceName := route.Service
+	if query, err := discover.ParseServiceQuery(route.Service); err == nil {
+		serviceName = query.Name
+	}
+	return defaults.
+		Merge(gc.Hystrix).
+		Merge(gc.Services[serviceName]).
+		Merge(route.Hystrix).
+		CommandConfig()
+}
+
+//从文件加载网关配置
+func LoadConfig(path string) (*GatewayConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(path, data)
+}
+
+//解析网关配置，name的扩展名为.json时按JSON解析，否则按YAML解析
+func ParseConfig(name string, data []byte) (*GatewayConfig, error) {
+	config := &GatewayConfig{}
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		err = json.Unmarshal(data, config)
+	default:
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//合并另一份配置：全局和服务的hystrix参数逐项覆盖，路由追加在后面
+func (gc *GatewayConfig) Merge(other *GatewayConfig) *GatewayConfig {
+	merged := &GatewayConfig{
+		Services: make(map[string]*HystrixConfig),
+	}
+	for _, c := range []*GatewayConfig{gc, other} {
+		if c == nil {
+			continue
+		}
+		if c.Hystrix != nil {
+			hystrixConfig := HystrixConfig{}.Merge(merged.Hystrix).Merge(c.Hystrix)
+			merged.Hystrix = &hystrixConfig
+		}
+		if len(c.FailureStatus) > 0 {
+			merged.FailureStatus = c.FailureStatus
+		}
+		for name, serviceConfig := range c.Services {
+			hystrixConfig := HystrixConfig{}.Merge(merged.Services[name]).Merge(serviceConfig)
+			merged.Services[name] = &hystrixConfig
+		}
+		for _, route := range c.Routes {
+			if route == nil {
+				continue
+			}
+			//NewRouteTable会修改路由，这里复制一份避免影响原配置
+			r := *route
+			merged.Routes = append(merged.Routes, &r)
+		}
+	}
+	return merged
+}
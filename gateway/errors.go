@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/afex/hystrix-go/hystrix"
+	"net/http"
+	"strconv"
+)
+
+//X-Hystrix-Status响应头及错误响应中code的取值
+const (
+	HystrixStatusCircuitOpen   = "circuit_open"
+	HystrixStatusRejected      = "rejected"
+	HystrixStatusTimeout       = "timeout"
+	HystrixStatusNoInstances   = "no_instances"
+	HystrixStatusUpstreamError = "upstream_error"
+)
+
+const HystrixStatusHeader = "X-Hystrix-Status"
+
+//网关错误响应
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Error   string `json:"error"`
+	Route   string `json:"route"`
+	Service string `json:"service"`
+}
+
+//根据hystrix.Do返回的异常确定响应状态码和X-Hystrix-Status
+func classifyError(err error) (int, string) {
+	switch err {
+	case hystrix.ErrCircuitOpen:
+		return http.StatusServiceUnavailable, HystrixStatusCircuitOpen
+	case hystrix.ErrMaxConcurrency:
+		return http.StatusTooManyRequests, HystrixStatusRejected
+	case hystrix.ErrTimeout:
+		return http.StatusGatewayTimeout, HystrixStatusTimeout
+	case ErrNoInstances:
+		return http.StatusServiceUnavailable, HystrixStatusNoInstances
+	default:
+		return http.StatusBadGateway, HystrixStatusUpstreamError
+	}
+}
+
+//写入错误响应，断路器打开时通过Retry-After告知客户端断路器进入半开状态的时间
+func writeError(rw http.ResponseWriter, err error, route *Route, sleepWindow int) {
+	statusCode, hystrixStatus := classifyError(err)
+	header := rw.Header()
+	header.Set("Content-Type", "application/json;charset=utf-8")
+	header.Set(HystrixStatusHeader, hystrixStatus)
+	if err == hystrix.ErrCircuitOpen {
+		if sleepWindow == 0 {
+			sleepWindow = hystrix.DefaultSleepWindow
+		}
+		//向上取整到秒
+		header.Set("Retry-After", strconv.Itoa((sleepWindow+999)/1000))
+	}
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(ErrorResponse{
+		Code:    hystrixStatus,
+		Error:   err.Error(),
+		Route:   route.Name,
+		Service: route.Service,
+	})
+}
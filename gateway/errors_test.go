@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/afex/hystrix-go/hystrix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{hystrix.ErrCircuitOpen, http.StatusServiceUnavailable, HystrixStatusCircuitOpen},
+		{hystrix.ErrMaxConcurrency, http.StatusTooManyRequests, HystrixStatusRejected},
+		{hystrix.ErrTimeout, http.StatusGatewayTimeout, HystrixStatusTimeout},
+		{ErrNoInstances, http.StatusServiceUnavailable, HystrixStatusNoInstances},
+		{&UpstreamStatusError{StatusCode: 500}, http.StatusBadGateway, HystrixStatusUpstreamError},
+		{errors.New("connection refused"), http.StatusBadGateway, HystrixStatusUpstreamError},
+	}
+	for _, test := range tests {
+		status, code := classifyError(test.err)
+		if status != test.status || code != test.code {
+			t.Errorf("classifyError(%v) = %d, %s; want %d, %s", test.err, status, code, test.status, test.code)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	route := &Route{Name: "strings", Service: "string"}
+	tests := []struct {
+		name        string
+		err         error
+		sleepWindow int
+		retryAfter  string
+	}{
+		{"circuit open", hystrix.ErrCircuitOpen, 1500, "2"},
+		{"circuit open with default sleep window", hystrix.ErrCircuitOpen, 0, "5"},
+		{"timeout", hystrix.ErrTimeout, 1500, ""},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		writeError(rw, test.err, route, test.sleepWindow)
+		status, code := classifyError(test.err)
+		if rw.Code != status {
+			t.Errorf("%s: status %d, want %d", test.name, rw.Code, status)
+		}
+		if got := rw.Header().Get(HystrixStatusHeader); got != code {
+			t.Errorf("%s: %s = %q, want %q", test.name, HystrixStatusHeader, got, code)
+		}
+		if got := rw.Header().Get("Retry-After"); got != test.retryAfter {
+			t.Errorf("%s: Retry-After = %q, want %q", test.name, got, test.retryAfter)
+		}
+		var body ErrorResponse
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if body.Code != code || body.Error != test.err.Error() || body.Route != "strings" || body.Service != "string" {
+			t.Errorf("%s: body = %+v", test.name, body)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"Hystrix/common/loadbalance"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//降级方式
+const (
+	//返回配置的静态响应
+	FallbackStatic = "static"
+	//转发到降级服务
+	FallbackService = "service"
+	//返回最近一次成功的响应，未命中时返回静态响应
+	FallbackCache = "cache"
+)
+
+//路由的降级配置
+type FallbackConfig struct {
+	//降级方式：static、service、cache
+	Type string `json:"type" yaml:"type"`
+	//静态响应的状态码，默认503
+	StatusCode int `json:"status_code" yaml:"status_code"`
+	//静态响应的Content-Type，默认application/json
+	ContentType string            `json:"content_type" yaml:"content_type"`
+	Headers     map[string]string `json:"headers" yaml:"headers"`
+	//静态响应内容
+	Body string `json:"body" yaml:"body"`
+	//降级服务名，请求按路由规则重写路径后转发到该服务
+	//请求体超过maxReplayBodySize时无法重新发送，不转发到降级服务
+	Service string `json:"service" yaml:"service"`
+	//缓存响应的有效期，单位毫秒，0表示不过期
+	MaxAge int `json:"max_age" yaml:"max_age"`
+}
+
+func (fc *FallbackConfig) validate() error {
+	switch fc.Type {
+	case FallbackStatic, FallbackCache:
+	case FallbackService:
+		if fc.Service == "" {
+			return fmt.Errorf("fallback service is required")
+		}
+	default:
+		return fmt.Errorf("unknown fallback type %q", fc.Type)
+	}
+	return nil
+}
+
+//写入静态响应
+func (fc *FallbackConfig) writeStatic(rw http.ResponseWriter) {
+	for k, v := range fc.Headers {
+		rw.Header().Set(k, v)
+	}
+	contentType := fc.ContentType
+	if contentType == "" {
+		contentType = "application/json;charset=utf-8"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	statusCode := fc.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusServiceUnavailable
+	}
+	rw.WriteHeader(statusCode)
+	rw.Write([]byte(fc.Body))
+}
+
+//转发到降级服务时可以重新发送的请求体上限
+const maxReplayBodySize = 1 << 20
+
+//路由配置了降级服务时缓存请求体，代理和降级请求各自读取一份，避免两个goroutine读取同一个请求体
+//请求体超过上限或读取失败时不缓存，剩余部分仍由代理读取
+func bufferBody(route *Route, req *http.Request) {
+	if route.Fallback == nil || route.Fallback.Type != FallbackService || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxReplayBodySize+1))
+	if err != nil || len(body) > maxReplayBodySize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+}
+
+//复制请求用于重新发送，请求体无法重新读取时返回false
+func replayRequest(req *http.Request) (*http.Request, bool) {
+	replay := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return replay, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	replay.Body = body
+	return replay, true
+}
+
+//缓存的成功响应
+type cachedResponse struct {
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+//缓存条目数上限，超过后随机淘汰
+const maxCachedResponses = 1024
+
+//按路由和请求URL缓存最近一次成功的GET响应
+type responseCache struct {
+	mutex   sync.RWMutex
+	entries map[string]*cachedResponse
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+func cacheKey(route *Route, req *http.Request) string {
+	return route.Name + " " + req.Host + req.URL.RequestURI()
+}
+
+func (c *responseCache) store(key string, response *cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCachedResponses {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = response
+}
+
+func (c *responseCache) load(key string, maxAge time.Duration) (*cachedResponse, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	response, ok := c.entries[key]
+	if !ok || (maxAge > 0 && time.Since(response.storedAt) > maxAge) {
+		return nil, false
+	}
+	return response, true
+}
+
+//路由是否需要缓存成功响应
+//缓存的响应会返回给其他用户，带身份信息的请求不缓存
+func cacheable(route *Route, req *http.Request) bool {
+	return route.Fallback != nil && route.Fallback.Type == FallbackCache && req.Method == http.MethodGet &&
+		req.Header.Get("Authorization") == "" && req.Header.Get("Cookie") == ""
+}
+
+//响应是否可以共享给其他用户：设置cookie、Cache-Control为private或no-store、Vary为*的响应不缓存
+func shareableResponse(header http.Header) bool {
+	if len(header["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "private" || strings.HasPrefix(directive, "private=") || directive == "no-store" {
+				return false
+			}
+		}
+	}
+	for _, value := range header["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.TrimSpace(field) == "*" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//执行路由配置的降级逻辑，未配置降级或降级失败时返回false
+func (hy *HystrixHandler) fallback(rw http.ResponseWriter, req *http.Request, route *Route) bool {
+	fc := route.Fallback
+	if fc == nil {
+		return false
+	}
+	switch fc.Type {
+	case FallbackService:
+		//降级服务不再使用hystrix保护，转发失败时返回默认错误
+		//原请求可能仍在被代理读取，使用缓存的请求体重新发送
+		replay, ok := replayRequest(req)
+		if !ok {
+			hy.logger.Println("fallback service", fc.Service, "skipped: request body can not be replayed")
+			return false
+		}
+		tw := newTrackingResponseWriter(rw, false)
+		instance, done, err := hy.selectInstance(fc.Service, route.hashKey(replay), nil)
+		if err == nil {
+			start := time.Now()
+			err = hy.forward(tw, replay, instance, route, nil)
+			done(loadbalance.DoneInfo{Err: err, Duration: time.Since(start)})
+		}
+		if err != nil {
+			hy.logger.Println("fallback service", fc.Service, "error", err)
+			return !tw.detach()
+		}
+		return true
+	case FallbackCache:
+		if response, ok := hy.cache.load(cacheKey(route, req), time.Duration(fc.MaxAge)*time.Millisecond); ok {
+			header := rw.Header()
+			for k, v := range response.header {
+				header[k] = v
+			}
+			header.Del("Date")
+			header.Set("Age", strconv.Itoa(int(time.Since(response.storedAt).Seconds())))
+			rw.WriteHeader(response.status)
+			rw.Write(response.body)
+			return true
+		}
+		//缓存未命中，未配置静态响应时返回默认错误
+		if fc.Body == "" && fc.StatusCode == 0 {
+			return false
+		}
+	}
+	fc.writeStatic(rw)
+	return true
+}
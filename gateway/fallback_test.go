@@ -0,0 +1,118 @@
+package main
+
+import (
+	"Hystrix/common/discover"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCacheFallbackDoesNotShareUserResponses(t *testing.T) {
+	var failing int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch req.URL.Path {
+		case "/cache/user":
+			rw.Header().Set("Set-Cookie", "session=user-"+req.Header.Get("Authorization"))
+			rw.Write([]byte("private data of " + req.Header.Get("Authorization")))
+		case "/cache/cookie":
+			rw.Header().Set("Set-Cookie", "session=anonymous")
+			rw.Write([]byte("cookie"))
+		case "/cache/private":
+			rw.Header().Set("Cache-Control", "max-age=60, private")
+			rw.Write([]byte("private"))
+		case "/cache/no-store":
+			rw.Header().Set("Cache-Control", "no-store")
+			rw.Write([]byte("no-store"))
+		case "/cache/vary":
+			rw.Header().Set("Vary", "Accept, *")
+			rw.Write([]byte("vary"))
+		default:
+			rw.Write([]byte("public"))
+		}
+	}))
+	defer upstream.Close()
+
+	hy := newTestGateway(t, Defaults{}, []*Route{{
+		Name:       "cache-fallback",
+		PathPrefix: "/cache",
+		Service:    "upstream",
+		Fallback:   &FallbackConfig{Type: FallbackCache, StatusCode: http.StatusServiceUnavailable, Body: "unavailable"},
+	}}, map[string][]*discover.ServiceInstance{"upstream": {testInstance(t, "upstream-1", upstream)}})
+	gateway := httptest.NewServer(hy)
+	defer gateway.Close()
+
+	get := func(path, authorization string) (int, string, *http.Response) {
+		req, _ := http.NewRequest(http.MethodGet, gateway.URL+path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp
+	}
+
+	//上游正常时记录响应
+	if _, body, _ := get("/cache/user", "alice"); body != "private data of alice" {
+		t.Fatalf("alice got %q", body)
+	}
+	for _, path := range []string{"/cache/public", "/cache/cookie", "/cache/private", "/cache/no-store", "/cache/vary"} {
+		if status, _, _ := get(path, ""); status != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, status)
+		}
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/cache/user", http.StatusServiceUnavailable, "unavailable"},
+		{"/cache/cookie", http.StatusServiceUnavailable, "unavailable"},
+		{"/cache/private", http.StatusServiceUnavailable, "unavailable"},
+		{"/cache/no-store", http.StatusServiceUnavailable, "unavailable"},
+		{"/cache/vary", http.StatusServiceUnavailable, "unavailable"},
+		//匿名请求的公共响应可以返回给其他用户
+		{"/cache/public", http.StatusOK, "public"},
+	}
+	for _, test := range tests {
+		status, body, resp := get(test.path, "bob")
+		if status != test.status || body != test.body {
+			t.Errorf("bob GET %s: %d %q, want %d %q", test.path, status, body, test.status, test.body)
+		}
+		if cookie := resp.Header.Get("Set-Cookie"); cookie != "" {
+			t.Errorf("bob GET %s: got Set-Cookie %q", test.path, cookie)
+		}
+	}
+}
+
+func TestShareableResponse(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{}, true},
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{http.Header{"Vary": {"Accept-Encoding"}}, true},
+		{http.Header{"Set-Cookie": {"session=1"}}, false},
+		{http.Header{"Cache-Control": {"Private"}}, false},
+		{http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false},
+		{http.Header{"Cache-Control": {"max-age=0", "no-store"}}, false},
+		{http.Header{"Vary": {"*"}}, false},
+	}
+	for _, test := range tests {
+		if got := shareableResponse(test.header); got != test.want {
+			t.Errorf("shareableResponse(%v) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"Hystrix/common/discover"
+	"Hystrix/common/lifecycle"
 	"Hystrix/common/loadbalance"
 	"flag"
-	"fmt"
 	kitlog "github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -18,6 +21,45 @@ func main() {
 	var (
 		consulHost = flag.String("consul.host", "127.0.0.1", "consul server ip address")
 		consulPort = flag.Int("conusl.port", 8500, "consul server port")
+		//服务发现后端
+		discoveryBackend  = flag.String("discovery", discover.BackendConsul, "discovery backend: consul, file, dns, registry")
+		discoveryFile     = flag.String("discovery.file", "", "yaml or json file listing service instances, used by -discovery=file")
+		discoveryInterval = flag.Duration("discovery.file-interval", 2*time.Second, "interval to check the discovery file for changes")
+		dnsResolver       = flag.String("discovery.dns-resolver", "", "dns server host:port used by -discovery=dns, default first nameserver in /etc/resolv.conf")
+		dnsDomain         = flag.String("discovery.dns-domain", "", "domain of the _service._tcp SRV records, e.g. service.consul")
+		dnsRefresh        = flag.Duration("discovery.dns-refresh", 0, "fixed interval to refresh SRV records, 0 to follow record TTL")
+		registryAddr      = flag.String("discovery.registry-addr", "127.0.0.1:8700", "address of the embedded registry used by -discovery=registry")
+		maxStaleness      = flag.Duration("discovery.max-staleness", 0, "max age of cached instances served while the discovery backend is unavailable, 0 for no limit")
+		//prometheus指标
+		metricsAddr = flag.String("metrics.addr", "", "address to serve prometheus /metrics on, empty to disable")
+		//优雅退出
+		propagationDelay = flag.Duration("shutdown.propagation-delay", 0, "time to keep serving after receiving SIGTERM before draining, e.g. for an external load balancer")
+		shutdownTimeout  = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "deadline for in-flight requests to finish on shutdown")
+
+		configFile = flag.String("config", "", "gateway route config file (yaml or json)")
+		//配置热加载
+		configInterval = flag.Duration("config.reload-interval", 5*time.Second, "interval to check the config file for changes")
+		configPrefix   = flag.String("config.consul-prefix", "", "consul KV prefix to watch for gateway config, empty to disable")
+
+		//网关全局的hystrix默认参数
+		hystrixTimeout       = flag.Int("hystrix.timeout", 3000, "default hystrix command timeout in milliseconds")
+		hystrixMaxConcurrent = flag.Int("hystrix.max-concurrent", 100, "default hystrix max concurrent requests per command")
+		hystrixVolume        = flag.Int("hystrix.volume-threshold", 20, "default hystrix request volume threshold")
+		hystrixSleepWindow   = flag.Int("hystrix.sleep-window", 5000, "default hystrix sleep window in milliseconds")
+		hystrixErrorPercent  = flag.Int("hystrix.error-percent", 50, "default hystrix error percent threshold")
+		hystrixPerInstance   = flag.Bool("hystrix.per-instance", false, "maintain a circuit per route/instance and skip instances whose circuit is open")
+		//负载均衡策略
+		lbStrategy = flag.String("loadbalance", loadbalance.StrategyRandom, "load balance strategy: random, weight-round-robin, least-request, p2c-ewma, consistent-hash")
+		slowStart  = flag.Duration("slow-start", 0, "warm-up window for newly discovered instances, 0 to disable")
+		zone       = flag.String("zone", "", "zone of the gateway, prefer upstream instances in the same zone")
+		zoneMin    = flag.Int("zone.min-capacity", 1, "minimum local zone capacity (sum of instance weights) before spilling over to other zones")
+		outlier    = flag.Bool("outlier", false, "eject instances with consecutive failures or high error rate from load balance")
+		outlierCF  = flag.Int("outlier.consecutive-failures", loadbalance.DefaultOutlierConfig.ConsecutiveFailures, "consecutive failures before an instance is ejected, 0 to disable")
+		outlierEP  = flag.Int("outlier.error-percent", loadbalance.DefaultOutlierConfig.ErrorPercent, "error percent within the interval before an instance is ejected, 0 to disable")
+		outlierBE  = flag.Duration("outlier.base-ejection", loadbalance.DefaultOutlierConfig.BaseEjectionTime, "base ejection time, doubled on each consecutive ejection")
+		outlierMEP = flag.Int("outlier.max-ejection-percent", loadbalance.DefaultOutlierConfig.MaxEjectionPercent, "max percent of instances of a service that can be ejected")
+		//上游响应状态码分类
+		failureStatus = flag.String("failure-status", strings.Join(DefaultFailureStatus, ","), "upstream status codes reported to hystrix as failures, e.g. 5xx,429,400-403")
 	)
 	flag.Parse()
 
@@ -34,33 +76,107 @@ func main() {
 	logger = kitlog.With(logger, "ts", kitlog.DefaultTimestampUTC)
 	logger = kitlog.With(logger, "caller", kitlog.DefaultCaller)
 
-	consulClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	stdLogger := log.New(os.Stderr, "", log.LstdFlags)
+	discoveryClient, err := discover.NewDiscoveryClientV2(discover.Options{
+		Backend:      *discoveryBackend,
+		MaxStaleness: *maxStaleness,
+		ConsulHost:   *consulHost,
+		ConsulPort:   *consulPort,
+		File:         *discoveryFile,
+		FileInterval: *discoveryInterval,
+		DNSResolver:  *dnsResolver,
+		DNSDomain:    *dnsDomain,
+		DNSRefresh:   *dnsRefresh,
+
+		RegistryAddress: *registryAddr,
+	}, stdLogger)
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(-1)
 	}
-	//创建方向代理
-	//TODO undefined: NewHystrixHandler
-	proxy := NewHystrixHandler(consulClient, new(loadbalance.RandomLoadBalance), log.New(os.Stderr, "", log.LstdFlags))
+	//加载路由表，未指定配置时沿用路径第一段作为服务名的路由方式
+	var kv *api.KV
+	if *configPrefix != "" {
+		consulConfig := api.DefaultConfig()
+		consulConfig.Address = *consulHost + ":" + strconv.Itoa(*consulPort)
+		apiClient, err := api.NewClient(consulConfig)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(-1)
+		}
+		kv = apiClient.KV()
+	}
+	configWatcher := NewConfigWatcher(*configFile, *configInterval, kv, *configPrefix, stdLogger)
+	gatewayConfig, err := configWatcher.Load()
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(-1)
+	}
+	defaults := Defaults{
+		Hystrix: HystrixConfig{
+			Timeout:                *hystrixTimeout,
+			MaxConcurrentRequests:  *hystrixMaxConcurrent,
+			RequestVolumeThreshold: *hystrixVolume,
+			SleepWindow:            *hystrixSleepWindow,
+			ErrorPercentThreshold:  *hystrixErrorPercent,
+		},
+		FailureStatus:      strings.Split(*failureStatus, ","),
+		PerInstanceCircuit: *hystrixPerInstance,
+	}
 
-	errC := make(chan error)
-	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errC <- fmt.Errorf("%s", <-c)
-	}()
+	//创建方向代理
+	lb, err := loadbalance.NewLoadBalance(*lbStrategy)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(-1)
+	}
+	//新实例在预热窗口内逐步增加流量
+	if *slowStart > 0 {
+		lb = loadbalance.NewSlowStartLoadBalance(*slowStart, lb)
+	}
+	//优先转发到相同可用区的实例
+	if *zone != "" {
+		lb = loadbalance.NewZoneAwareLoadBalance(*zone, *zoneMin, lb)
+	}
+	//摘除连续失败或错误率过高的实例
+	if *outlier {
+		outlierConfig := loadbalance.DefaultOutlierConfig
+		outlierConfig.ConsecutiveFailures = *outlierCF
+		outlierConfig.ErrorPercent = *outlierEP
+		outlierConfig.BaseEjectionTime = *outlierBE
+		outlierConfig.MaxEjectionPercent = *outlierMEP
+		lb = loadbalance.NewOutlierLoadBalance(outlierConfig, lb)
+	}
+	proxy, err := NewHystrixHandler(gatewayConfig, defaults, discover.NewDiscoveryClientAdapter(discoveryClient), lb, stdLogger)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(-1)
+	}
+	//退出时等待处理中的请求完成，然后按相反顺序停止配置监控、取消服务实例的订阅、停止服务发现
+	lc := lifecycle.New(*propagationDelay, *shutdownTimeout, nil, stdLogger)
+	lc.OnStop(discoveryClient.Close)
+	lc.OnStop(proxy.Close)
+	//监控配置变化，热加载路由表和hystrix命令
+	configWatcher.Watch(proxy)
+	lc.OnStop(configWatcher.Stop)
 
 	//开始监听
-	go func() {
-		logger.Log("transort", "HTTP", "addr", "9090")
-		/*
-			ListenAndServe侦听TCP网络地址addr，然后调用带有处理程序的Serve来处理传入连接上的请求。
-			接受的连接被配置为启用TCP长连接。处理程序通常为nil，在这种情况下，将使用DefaultServeMux。
-			ListenAndServe始终返回非nil错误。
-		*/
-		errC <- http.ListenAndServe(":9090", proxy)
-	}()
+	logger.Log("transort", "HTTP", "addr", "9090")
+	/*
+		ListenAndServe侦听TCP网络地址addr，然后调用带有处理程序的Serve来处理传入连接上的请求。
+		接受的连接被配置为启用TCP长连接。处理程序通常为nil，在这种情况下，将使用DefaultServeMux。
+		Shutdown关闭监听后等待已接受的连接上的请求处理完成。
+	*/
+	lc.Serve(&http.Server{Addr: ":9090", Handler: proxy})
+
+	//服务发现缓存等指标，与网关转发的端口分开
+	if *metricsAddr != "" {
+		logger.Log("transort", "HTTP", "metrics", *metricsAddr)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		lc.Serve(&http.Server{Addr: *metricsAddr, Handler: mux})
+	}
 
 	//等待结束
-	logger.Log("exit", <-errC)
+	logger.Log("exit", lc.Run())
 }
@@ -1,3 +1,7 @@
+//go:build ignore
+// +build ignore
+
+//hystrix-go使用示例，通过 go run hystrix-example.go 单独运行
 package main
 
 import (
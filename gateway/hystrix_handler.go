@@ -1,40 +1,144 @@
 package main
 
 import (
+	"Hystrix/common/circuit"
 	"Hystrix/common/discover"
 	"Hystrix/common/loadbalance"
 	"errors"
 	"fmt"
 	"github.com/afex/hystrix-go/hystrix"
-	"github.com/hashicorp/consul/api"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNoInstances = errors.New("query service instance error")
 
 type HystrixHandler struct {
-	//map记录hystrix当前注册的hystrix命令
-	hystrixs     map[string]bool
-	hystrixMutex *sync.Mutex
+	//当前生效的路由表和配置，热加载时整体替换
+	state atomic.Value
+	//热加载时串行执行，避免并发Reload交错配置hystrix命令
+	reloadMutex *sync.Mutex
+	//命令行参数提供的默认配置
+	defaults Defaults
+
+	//最近一次成功的响应，用于cache降级
+	cache *responseCache
+	//实例级别断路器，开启PerInstanceCircuit时使用
+	breakers *circuit.InstanceBreakers
 
 	disvoceryClient discover.DiscoveryClient
 	loadbalance     loadbalance.LoadBalance
 	logger          *log.Logger
+
+	//按服务名订阅实例变化，变化时重建负载均衡器
+	watchMutex *sync.Mutex
+	watches    map[string]func()
+}
+
+//一份生效中的网关配置，正在处理的请求持有旧的routeState直到结束
+type routeState struct {
+	routes *RouteTable
+	config *GatewayConfig
+	//记录当前配置下已注册的hystrix命令
+	hystrixs sync.Map
+	//全局及按路由名称的上游响应状态码分类
+	failureStatus      StatusClassifier
+	routeFailureStatus map[string]StatusClassifier
+}
+
+//路由使用的状态码分类
+func (state *routeState) failureClassifier(route *Route) StatusClassifier {
+	if classifier, ok := state.routeFailureStatus[route.Name]; ok {
+		return classifier
+	}
+	return state.failureStatus
 }
 
-func NewHystrixHandler(discoverClient discover.DiscoveryClient, loadbalance loadbalance.LoadBalance, logger *log.Logger) *HystrixHandler {
-	return &HystrixHandler{
-		hystrixs:     make(map[string]bool),
-		hystrixMutex: &sync.Mutex{},
+func NewHystrixHandler(config *GatewayConfig, defaults Defaults, discoverClient discover.DiscoveryClient, loadbalance loadbalance.LoadBalance, logger *log.Logger) (*HystrixHandler, error) {
+	hy := &HystrixHandler{
+		reloadMutex: &sync.Mutex{},
+		defaults:    defaults,
+		cache:       newResponseCache(),
+		breakers:    circuit.NewInstanceBreakers(),
 
 		disvoceryClient: discoverClient,
 		loadbalance:     loadbalance,
 		logger:          logger,
+
+		watchMutex: &sync.Mutex{},
+		watches:    make(map[string]func()),
+	}
+	if err := hy.Reload(config); err != nil {
+		return nil, err
+	}
+	return hy, nil
+}
+
+//使用新的配置替换路由表并重新配置hystrix命令，配置有误时保留原配置
+func (hy *HystrixHandler) Reload(config *GatewayConfig) error {
+	routes, err := NewRouteTable(config.Routes)
+	if err != nil {
+		return err
+	}
+	failureStatus := config.FailureStatus
+	if len(failureStatus) == 0 {
+		failureStatus = hy.defaults.FailureStatus
+	}
+	classifier, err := ParseStatusClassifier(failureStatus)
+	if err != nil {
+		return err
+	}
+	state := &routeState{
+		routes:             routes,
+		config:             config,
+		failureStatus:      classifier,
+		routeFailureStatus: make(map[string]StatusClassifier),
+	}
+	for _, route := range routes.routes {
+		if len(route.FailureStatus) == 0 {
+			continue
+		}
+		classifier, err := ParseStatusClassifier(route.FailureStatus)
+		if err != nil {
+			return fmt.Errorf("route %s: %v", route.Name, err)
+		}
+		state.routeFailureStatus[route.Name] = classifier
+	}
+
+	hy.reloadMutex.Lock()
+	defer hy.reloadMutex.Unlock()
+
+	//hystrix在创建断路器时按MaxConcurrentRequests创建执行池，之后不再读取该参数，
+	//修改了已有命令的最大并发数时需要重建断路器
+	flush := false
+	settings := hystrix.GetCircuitSettings()
+	for _, route := range routes.routes {
+		commandConfig := config.CommandConfig(hy.defaults.Hystrix, route)
+		if old, ok := settings[route.Name]; ok && old.MaxConcurrentRequests != commandConfig.MaxConcurrentRequests {
+			flush = true
+		}
+		//实例级别的命令在请求时按需配置，这里只检查是否需要重建
+		for name, old := range settings {
+			if strings.HasPrefix(name, route.Name+"/") && old.MaxConcurrentRequests != commandConfig.MaxConcurrentRequests {
+				flush = true
+			}
+		}
+		hystrix.ConfigureCommand(route.Name, commandConfig)
+		state.hystrixs.Store(route.Name, true)
+	}
+	if flush {
+		hy.logger.Println("max concurrent requests changed, flush hystrix circuits")
+		hystrix.Flush()
 	}
+
+	hy.state.Store(state)
+	hy.logger.Println("gateway config loaded, routes:", len(routes.routes))
+	return nil
 }
 
 func (hy *HystrixHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -42,89 +146,216 @@ func (hy *HystrixHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if reqPath == "" {
 		return
 	}
-	//获取服务名称
-	pathArray := strings.Split(reqPath, "/")
-	//服务名称
-	serviceName := pathArray[1]
-	if serviceName == "" {
+	state := hy.state.Load().(*routeState)
+	//根据路由表查找目标服务
+	route := state.routes.Match(req)
+	if route == nil {
 		//路径不存在
 		rw.WriteHeader(404)
 		return
 	}
-	//查询hystrix命令
-	if _, ok := hy.hystrixs[serviceName]; !ok {
-		hy.hystrixMutex.Lock()
-		if _, ok := hy.hystrixs[serviceName]; !ok {
-			//把serviceName作为 hystrix命令命名
-			hystrix.ConfigureCommand(serviceName, hystrix.CommandConfig{
-				//进行hystrix命令自定义
-			})
-			hy.hystrixs[serviceName] = true
+	failureStatus := state.failureClassifier(route)
+	bufferBody(route, req)
+	//记录响应是否已经发送，hystrix执行失败时由降级逻辑接管
+	tw := newTrackingResponseWriter(rw, cacheable(route, req))
+	//响应头已经发送后执行失败，需要中断连接，否则客户端会收到被截断但看似正常结束的响应
+	var aborted int32
+	defer func() {
+		if atomic.LoadInt32(&aborted) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+	}()
+	fallback := func(err error) error {
+		hy.logger.Println("proxy error", route.Name, err)
+		//接管响应，之后代理的写入全部丢弃
+		if !tw.detach() {
+			//响应头已经发送给客户端，无法再返回降级响应，由ServeHTTP所在的goroutine中断连接
+			atomic.StoreInt32(&aborted, 1)
+			return err
 		}
-		hy.hystrixMutex.Unlock()
+		//标记失败原因，降级响应同样带上该响应头
+		_, hystrixStatus := classifyError(err)
+		rw.Header().Set(HystrixStatusHeader, hystrixStatus)
+		if hy.fallback(rw, req, route) {
+			return nil
+		}
+		//未配置降级时，按失败原因返回错误
+		writeError(rw, err, route, state.config.CommandConfig(hy.defaults.Hystrix, route).SleepWindow)
+		return err
+	}
+	if hy.defaults.PerInstanceCircuit {
+		hy.serveInstance(tw, req, state, route, failureStatus, fallback)
+		return
 	}
-	err := hystrix.Do(serviceName, func() error {
 
-		//根据请求路径中提供的服务名从discoveryClient中获取服务列表
-		instances := hy.disvoceryClient.DiscoverServices(serviceName, hy.logger)
-		instanceList := make([]*api.AgentService, len(instances))
-		for i := 0; i < len(instances); i++ {
-			instanceList[i] = instances[i].(*api.AgentService)
-		}
-		//使用负载均衡算法选取实例
-		selectedInstance, err := hy.loadbalance.SelectService(instanceList)
+	//路由名称作为hystrix命令名称
+	commandName := route.Name
+	state.configureCommand(commandName, hy.defaults.Hystrix, route)
+	hystrix.Do(commandName, func() error {
+		instance, done, err := hy.selectInstance(route.Service, route.hashKey(req), nil)
 		if err != nil {
-			return ErrNoInstances
+			return err
+		}
+		//请求结束后将结果和耗时反馈给负载均衡器
+		start := time.Now()
+		err = hy.forward(tw, req, instance, route, failureStatus)
+		done(loadbalance.DoneInfo{Err: err, Duration: time.Since(start)})
+		if err == nil {
+			hy.storeCache(tw, route, req)
 		}
+		//将执行异常反馈给hystrix
+		return err
+	}, fallback)
+}
 
-		//创建Director
-		director := func(req *http.Request) {
-			//重新组织请求路径，去掉服务名称
-			destPath := strings.Join(pathArray[2:], "/")
+//每个实例使用独立的hystrix命令，负载均衡时跳过断路器打开的实例，所有实例的断路器都打开时才降级
+func (hy *HystrixHandler) serveInstance(tw *trackingResponseWriter, req *http.Request, state *routeState, route *Route, failureStatus StatusClassifier, fallback func(error) error) {
+	instance, done, err := hy.selectInstance(route.Service, route.hashKey(req), func(instances []*discover.ServiceInstance) []*discover.ServiceInstance {
+		return hy.breakers.Available(route.Name, instances)
+	})
+	if err != nil {
+		fallback(err)
+		return
+	}
+	//hystrix拒绝执行时run不会被调用，保证负载均衡器的反馈只执行一次
+	var once sync.Once
+	finish := func(info loadbalance.DoneInfo) {
+		once.Do(func() {
+			done(info)
+		})
+	}
+	commandName := circuit.InstanceCommandName(route.Name, instance.ID)
+	state.configureCommand(commandName, hy.defaults.Hystrix, route)
+	hystrix.Do(commandName, func() error {
+		start := time.Now()
+		err := hy.forward(tw, req, instance, route, failureStatus)
+		finish(loadbalance.DoneInfo{Err: err, Duration: time.Since(start)})
+		if err == nil {
+			hy.storeCache(tw, route, req)
+		}
+		return err
+	}, func(err error) error {
+		finish(loadbalance.DoneInfo{Err: err})
+		return fallback(err)
+	})
+}
 
-			hy.logger.Println("service id", selectedInstance.ID)
+//按需配置hystrix命令，已在当前配置下注册的命令不重复配置
+func (state *routeState) configureCommand(commandName string, defaults HystrixConfig, route *Route) {
+	if _, ok := state.hystrixs.Load(commandName); !ok {
+		//按路由、服务和全局配置进行hystrix命令自定义
+		hystrix.ConfigureCommand(commandName, state.config.CommandConfig(defaults, route))
+		state.hystrixs.Store(commandName, true)
+	}
+}
 
-			//设置代理服务地址信息
-			req.URL.Scheme = "http"
-			req.URL.Host = fmt.Sprintf("%s:%d", selectedInstance.Address, selectedInstance.Port)
-			req.URL.Path = "/" + destPath
+//缓存成功的响应，用于cache降级
+func (hy *HystrixHandler) storeCache(tw *trackingResponseWriter, route *Route, req *http.Request) {
+	if status, header, body, ok := tw.captured(); ok && status < 300 {
+		hy.cache.store(cacheKey(route, req), &cachedResponse{
+			status:   status,
+			header:   header,
+			body:     body,
+			storedAt: time.Now(),
+		})
+	}
+}
 
+//查询服务实例并使用负载均衡算法选取一个，key不为空时按key选取；
+//available不为nil时只在其返回的实例中选取，没有可用实例时返回hystrix.ErrCircuitOpen
+func (hy *HystrixHandler) selectInstance(serviceName, key string, available func([]*discover.ServiceInstance) []*discover.ServiceInstance) (*discover.ServiceInstance, loadbalance.DoneFunc, error) {
+	hy.watch(serviceName)
+	//根据服务名从discoveryClient中获取服务列表
+	instanceList := hy.disvoceryClient.DiscoverServices(serviceName, hy.logger)
+	if len(instanceList) == 0 {
+		return nil, nil, ErrNoInstances
+	}
+	if available != nil {
+		if instanceList = available(instanceList); len(instanceList) == 0 {
+			return nil, nil, hystrix.ErrCircuitOpen
 		}
-		var proxyError error
-		//返回代理异常，用于记录hystrix.Do执行失败
-		errHandler := func(ew http.ResponseWriter, er *http.Request, err error) {
-			proxyError = err
-		}
+	}
+	//使用负载均衡算法选取实例，路由配置了hash_key时相同key的请求转发到相同实例
+	selectedInstance, done, err := loadbalance.SelectByKey(hy.loadbalance, serviceName, instanceList, key)
+	if err != nil {
+		return nil, nil, ErrNoInstances
+	}
+	return selectedInstance, done, nil
+}
 
-		proxy := &httputil.ReverseProxy{
-			Director:     director,
-			ErrorHandler: errHandler,
-		}
+//第一次转发到某个服务时订阅其实例变化
+func (hy *HystrixHandler) watch(serviceName string) {
+	hy.watchMutex.Lock()
+	defer hy.watchMutex.Unlock()
+	if hy.watches == nil {
+		//已经Close
+		return
+	}
+	if _, ok := hy.watches[serviceName]; !ok {
+		hy.watches[serviceName] = loadbalance.RebuildOnChange(hy.disvoceryClient, hy.loadbalance, serviceName)
+	}
+}
 
-		//进行代理转发
-		proxy.ServeHTTP(rw, req)
+//取消所有服务实例的订阅
+func (hy *HystrixHandler) Close() {
+	hy.watchMutex.Lock()
+	defer hy.watchMutex.Unlock()
+	for _, cancel := range hy.watches {
+		cancel()
+	}
+	hy.watches = nil
+}
 
-		//将执行异常反馈给hystrix
-		return proxyError
-	}, func(err error) error {
-		hy.logger.Println("proxy error", err)
-		return errors.New("fallback excute")
-	})
+//将请求转发到选取的实例，返回代理异常或上游失败状态码
+//failureStatus为nil时不检查上游响应状态码
+func (hy *HystrixHandler) forward(rw *trackingResponseWriter, req *http.Request, selectedInstance *discover.ServiceInstance, route *Route, failureStatus StatusClassifier) (proxyError error) {
+	//创建Director
+	director := func(req *http.Request) {
+		hy.logger.Println("service id", selectedInstance.ID)
 
-	//返回hystrix.Do执行的异常
-	if err != nil {
-		/*
-			如果未显式调用WriteHeader，则首次调用Write
-			将触发一个隐式的WriteHeader（http.StatusOK）。
-			因此，对WriteHeader的显式调用主要用于
-			发送错误代码。
-
-			提供的代码必须是有效的HTTP 1xx-5xx状态代码。
-			只能写入一个头。 当前不支持发送用户定义的1xx信息标题，
-			除了100继续响应标头，读取Request.Body时，服务器会自动发送。
-		*/
-		//如果hystrix.DO中执行额代理转发逻辑出错，向客户端返回500的错误
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
+		//设置代理服务地址信息
+		req.URL.Scheme = "http"
+		req.URL.Host = selectedInstance.Address()
+		//按路由规则重写请求路径
+		req.URL.Path = route.RewritePath(req.URL.Path)
+		req.URL.RawPath = ""
 	}
+	//返回代理异常，用于记录hystrix.Do执行失败
+	errHandler := func(ew http.ResponseWriter, er *http.Request, err error) {
+		proxyError = err
+	}
+	//按状态码判断上游响应是否失败
+	//配置了降级时不转发失败的响应，交给降级逻辑处理；否则原样转发给客户端
+	modifyResponse := func(resp *http.Response) error {
+		if failureStatus.IsFailure(resp.StatusCode) {
+			err := &UpstreamStatusError{StatusCode: resp.StatusCode}
+			if route.Fallback != nil {
+				return err
+			}
+			proxyError = err
+		}
+		return nil
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director:       director,
+		ErrorHandler:   errHandler,
+		ModifyResponse: modifyResponse,
+	}
+
+	//客户端断开或降级逻辑接管响应后代理写入失败，ReverseProxy会以http.ErrAbortHandler退出，
+	//代理运行在hystrix的goroutine中，需要在这里恢复，否则会导致整个进程退出
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			proxyError = http.ErrAbortHandler
+		}
+	}()
+
+	//进行代理转发
+	proxy.ServeHTTP(rw, req)
+	rw.writeTrailers()
+	return proxyError
 }
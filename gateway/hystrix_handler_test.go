@@ -0,0 +1,274 @@
+package main
+
+import (
+	"Hystrix/common/circuit"
+	"Hystrix/common/discover"
+	"Hystrix/common/loadbalance"
+	"github.com/afex/hystrix-go/hystrix"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//返回固定实例列表的服务发现
+type staticDiscovery struct {
+	instances map[string][]*discover.ServiceInstance
+}
+
+func (d *staticDiscovery) Register(serviceName, instanceId, healthCheckUrl string, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+	return true
+}
+
+func (d *staticDiscovery) Deregister(instanceId string, logger *log.Logger) bool {
+	return true
+}
+
+func (d *staticDiscovery) DiscoverServices(serviceName string, logger *log.Logger) []*discover.ServiceInstance {
+	return d.instances[serviceName]
+}
+
+func (d *staticDiscovery) Watch(serviceName string) (<-chan []*discover.ServiceInstance, func()) {
+	instancesC := make(chan []*discover.ServiceInstance, 1)
+	instancesC <- d.instances[serviceName]
+	return instancesC, func() {}
+}
+
+//httptest服务器对应的服务实例
+func testInstance(t *testing.T, id string, server *httptest.Server) *discover.ServiceInstance {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &discover.ServiceInstance{ID: id, Name: "upstream", Host: host, Port: p, Weight: 1, Health: discover.HealthPassing}
+}
+
+//使用路由和实例创建网关，路由名即hystrix命令名，各测试需要使用不同的路由名
+func newTestGateway(t *testing.T, defaults Defaults, routes []*Route, instances map[string][]*discover.ServiceInstance) *HystrixHandler {
+	if defaults.FailureStatus == nil {
+		defaults.FailureStatus = DefaultFailureStatus
+	}
+	hy, err := NewHystrixHandler(&GatewayConfig{Routes: routes}, defaults, &staticDiscovery{instances: instances},
+		&loadbalance.RandomLoadBalance{}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hy
+}
+
+func TestFailureAfterCommitAbortsResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("partial"))
+		rw.(http.Flusher).Flush()
+		select {
+		case <-req.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	hy := newTestGateway(t, Defaults{}, []*Route{{
+		Name:       "abort-after-commit",
+		PathPrefix: "/slow",
+		Service:    "upstream",
+		Hystrix:    &HystrixConfig{Timeout: 100},
+		Fallback:   &FallbackConfig{Type: FallbackStatic, Body: "fallback"},
+	}}, map[string][]*discover.ServiceInstance{"upstream": {testInstance(t, "upstream-1", upstream)}})
+	gateway := httptest.NewServer(hy)
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "partial" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, "partial")
+	}
+	if err == nil {
+		t.Error("truncated response ended without error")
+	}
+}
+
+func TestFallbackAfterTimeout(t *testing.T) {
+	var slow int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(300 * time.Millisecond):
+			}
+		}
+		rw.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	//降级服务返回收到的请求体
+	backup := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write([]byte("backup " + req.URL.Path + " " + string(body)))
+	}))
+	defer backup.Close()
+
+	//路由名同时作为路径
+	tests := []struct {
+		route    string
+		fallback *FallbackConfig
+		status   int
+		body     string
+	}{
+		{"timeout-none", nil, http.StatusGatewayTimeout, ""},
+		{"timeout-static", &FallbackConfig{Type: FallbackStatic, StatusCode: http.StatusOK, Body: "static"}, http.StatusOK, "static"},
+		{"timeout-service", &FallbackConfig{Type: FallbackService, Service: "backup"}, http.StatusOK, "backup /timeout-service payload"},
+		{"timeout-cache", &FallbackConfig{Type: FallbackCache}, http.StatusOK, "upstream"},
+	}
+	var routes []*Route
+	for _, test := range tests {
+		routes = append(routes, &Route{
+			Name:       test.route,
+			PathPrefix: "/" + test.route,
+			Service:    "upstream",
+			Hystrix:    &HystrixConfig{Timeout: 50},
+			Fallback:   test.fallback,
+		})
+	}
+	hy := newTestGateway(t, Defaults{}, routes, map[string][]*discover.ServiceInstance{
+		"upstream": {testInstance(t, "upstream-1", upstream)},
+		"backup":   {testInstance(t, "backup-1", backup)},
+	})
+	gateway := httptest.NewServer(hy)
+	defer gateway.Close()
+
+	for _, test := range tests {
+		method, body := http.MethodGet, ""
+		if test.fallback != nil && test.fallback.Type == FallbackService {
+			method, body = http.MethodPost, "payload"
+		}
+		//上游正常时的响应作为缓存
+		atomic.StoreInt32(&slow, 0)
+		if resp, err := http.Get(gateway.URL + "/" + test.route); err == nil {
+			resp.Body.Close()
+		}
+		atomic.StoreInt32(&slow, 1)
+
+		req, _ := http.NewRequest(method, gateway.URL+"/"+test.route, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.route, err)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.route, err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status %d, want %d", test.route, resp.StatusCode, test.status)
+		}
+		if test.body != "" && string(got) != test.body {
+			t.Errorf("%s: body %q, want %q", test.route, got, test.body)
+		}
+		if status := resp.Header.Get(HystrixStatusHeader); status != HystrixStatusTimeout {
+			t.Errorf("%s: %s = %q, want %q", test.route, HystrixStatusHeader, status, HystrixStatusTimeout)
+		}
+	}
+}
+
+func TestUpstreamTrailersAreForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+
+	hy := newTestGateway(t, Defaults{}, []*Route{{
+		Name:       "trailers",
+		PathPrefix: "/trailers",
+		Service:    "upstream",
+		Fallback:   &FallbackConfig{Type: FallbackStatic, Body: "fallback"},
+	}}, map[string][]*discover.ServiceInstance{"upstream": {testInstance(t, "upstream-1", upstream)}})
+	gateway := httptest.NewServer(hy)
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/trailers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "body" {
+		t.Errorf("body %q, want %q", body, "body")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer X-Checksum = %q, want abc", got)
+	}
+}
+
+func TestPerInstanceCircuitSkipsOpenInstances(t *testing.T) {
+	newUpstream := func(status int, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(status)
+			rw.Write([]byte(body))
+		}))
+	}
+	good := newUpstream(http.StatusOK, "good")
+	defer good.Close()
+	bad := newUpstream(http.StatusInternalServerError, "bad")
+	defer bad.Close()
+
+	hystrixConfig := &HystrixConfig{RequestVolumeThreshold: 2, ErrorPercentThreshold: 50, SleepWindow: 60000}
+	fallback := &FallbackConfig{Type: FallbackStatic, StatusCode: http.StatusServiceUnavailable, Body: "fallback"}
+	hy := newTestGateway(t, Defaults{PerInstanceCircuit: true}, []*Route{
+		{Name: "per-instance-mixed", PathPrefix: "/mixed", Service: "mixed", Hystrix: hystrixConfig, Fallback: fallback},
+		{Name: "per-instance-bad", PathPrefix: "/bad", Service: "bad", Hystrix: hystrixConfig, Fallback: fallback},
+	}, map[string][]*discover.ServiceInstance{
+		"mixed": {testInstance(t, "good", good), testInstance(t, "bad", bad)},
+		"bad":   {testInstance(t, "bad", bad)},
+	})
+	gateway := httptest.NewServer(hy)
+	defer gateway.Close()
+
+	get := func(path string) (string, string) {
+		resp, err := http.Get(gateway.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.Header.Get(HystrixStatusHeader)
+	}
+	//hystrix异步统计请求结果，持续发送请求直到实例的断路器打开
+	waitOpen := func(path, commandName string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			get(path)
+			if c, _, err := hystrix.GetCircuit(commandName); err == nil && c.IsOpen() {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("circuit %s did not open", commandName)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitOpen("/mixed", circuit.InstanceCommandName("per-instance-mixed", "bad"))
+	for i := 0; i < 20; i++ {
+		if body, _ := get("/mixed"); body != "good" {
+			t.Fatalf("request %d got %q, want the open instance to be skipped", i, body)
+		}
+	}
+
+	//所有实例的断路器都打开时才降级
+	waitOpen("/bad", circuit.InstanceCommandName("per-instance-bad", "bad"))
+	if body, status := get("/bad"); body != "fallback" || status != HystrixStatusCircuitOpen {
+		t.Errorf("got %q with %s %q, want the fallback for an open circuit", body, HystrixStatusHeader, status)
+	}
+}
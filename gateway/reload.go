@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//配置热加载：监控配置文件和consul KV前缀，变更后合并配置并交给网关重新加载
+//consul KV前缀下的每个key都是一份YAML或JSON格式的网关配置，按key的顺序合并在配置文件之后
+type ConfigWatcher struct {
+	file     string
+	interval time.Duration
+
+	kv     *api.KV
+	prefix string
+
+	handler *HystrixHandler
+	logger  *log.Logger
+
+	mutex       sync.Mutex
+	fileData    []byte
+	fileConfig  *GatewayConfig
+	consulIndex uint64
+	kvConfig    *GatewayConfig
+
+	//Stop时取消，同时中断进行中的consul阻塞查询
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+//file为空时不监控文件，kv为nil时不监控consul
+func NewConfigWatcher(file string, interval time.Duration, kv *api.KV, prefix string, logger *log.Logger) *ConfigWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ConfigWatcher{
+		file:     file,
+		interval: interval,
+		kv:       kv,
+		prefix:   prefix,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+//同步加载一次配置，用于网关启动
+func (w *ConfigWatcher) Load() (*GatewayConfig, error) {
+	if w.file != "" {
+		if _, err := w.loadFile(); err != nil {
+			return nil, err
+		}
+	}
+	if w.kv != nil {
+		if _, err := w.loadConsul(0); err != nil {
+			return nil, err
+		}
+	}
+	return w.merged(), nil
+}
+
+//开始监控配置变化，变更后调用handler.Reload
+func (w *ConfigWatcher) Watch(handler *HystrixHandler) {
+	w.handler = handler
+	if w.file != "" {
+		go w.watchFile()
+	}
+	if w.kv != nil {
+		go w.watchConsul()
+	}
+}
+
+//停止监控，正在等待的consul阻塞查询立即返回
+func (w *ConfigWatcher) Stop() {
+	w.cancel()
+}
+
+func (w *ConfigWatcher) merged() *GatewayConfig {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.fileConfig.Merge(w.kvConfig)
+}
+
+func (w *ConfigWatcher) reload(source string) {
+	if err := w.handler.Reload(w.merged()); err != nil {
+		w.logger.Println("reload gateway config from", source, "error:", err)
+	}
+}
+
+//读取配置文件，内容未变化时返回false
+func (w *ConfigWatcher) loadFile() (bool, error) {
+	data, err := ioutil.ReadFile(w.file)
+	if err != nil {
+		return false, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.fileConfig != nil && bytes.Equal(data, w.fileData) {
+		return false, nil
+	}
+	config, err := ParseConfig(w.file, data)
+	if err != nil {
+		return false, err
+	}
+	w.fileData = data
+	w.fileConfig = config
+	return true, nil
+}
+
+//定时检查配置文件内容
+func (w *ConfigWatcher) watchFile() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := w.loadFile()
+			if err != nil {
+				w.logger.Println("load gateway config file error:", err)
+				continue
+			}
+			if changed {
+				w.reload(w.file)
+			}
+		}
+	}
+}
+
+//读取consul KV前缀下的配置，waitIndex不为0时阻塞等待变化，索引未变化时返回false
+func (w *ConfigWatcher) loadConsul(waitIndex uint64) (bool, error) {
+	pairs, meta, err := w.kv.List(w.prefix, (&api.QueryOptions{WaitIndex: waitIndex}).WithContext(w.ctx))
+	if err != nil {
+		return false, err
+	}
+	if meta.LastIndex == waitIndex {
+		return false, nil
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	var config *GatewayConfig
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		c, err := ParseConfig(pair.Key, pair.Value)
+		if err != nil {
+			return false, err
+		}
+		config = config.Merge(c)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.consulIndex = meta.LastIndex
+	w.kvConfig = config
+	return true, nil
+}
+
+//使用consul阻塞查询监控KV前缀
+func (w *ConfigWatcher) watchConsul() {
+	for w.ctx.Err() == nil {
+		w.mutex.Lock()
+		index := w.consulIndex
+		w.mutex.Unlock()
+
+		changed, err := w.loadConsul(index)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.logger.Println("load gateway config from consul error:", err)
+			//出错后等待一个周期再重试，避免频繁请求consul
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(w.interval):
+			}
+			continue
+		}
+		if changed {
+			w.reload("consul:" + w.prefix)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcherStopInterruptsConsulQuery(t *testing.T) {
+	blocking := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	//模拟consul KV接口：第一次查询立即返回，之后的阻塞查询一直等待到请求被取消
+	consul := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Consul-Index", "1")
+		if req.URL.Query().Get("index") == "" {
+			rw.Write([]byte(`[{"Key":"gateway/routes.yaml","Value":"cm91dGVzOiBbXQ=="}]`))
+			return
+		}
+		blocking <- struct{}{}
+		select {
+		case <-req.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * time.Second):
+			rw.Write([]byte(`[]`))
+		}
+	}))
+	defer consul.Close()
+
+	client, err := api.NewClient(&api.Config{Address: consul.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewConfigWatcher("", time.Second, client.KV(), "gateway/", log.New(ioutil.Discard, "", 0))
+	if _, err := w.Load(); err != nil {
+		t.Fatal(err)
+	}
+	w.Watch(nil)
+	select {
+	case <-blocking:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not start a blocking query")
+	}
+
+	w.Stop()
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop did not cancel the blocking query")
+	}
+}
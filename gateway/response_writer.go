@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//降级响应接管后，代理继续写入时返回该错误
+var ErrResponseDetached = errors.New("response has been taken over by fallback")
+
+//记录响应状态的ResponseWriter，用于包装交给反向代理的ResponseWriter
+//hystrix超时后代理可能仍在另一个goroutine中写入，降级逻辑通过detach接管响应，
+//之后代理写入的内容全部丢弃，避免重复写入响应头或把降级内容拼接在部分响应之后
+type trackingResponseWriter struct {
+	rw http.ResponseWriter
+	//代理使用独立的header，写入响应头时再复制，避免与降级逻辑并发修改
+	header http.Header
+
+	mutex       sync.Mutex
+	status      int
+	wroteHeader bool
+	detached    bool
+
+	//记录响应内容，用于缓存最近一次成功的响应，超过上限后不再记录
+	capture   bool
+	body      bytes.Buffer
+	truncated bool
+}
+
+//缓存响应内容的上限
+const maxCaptureSize = 1 << 20
+
+func newTrackingResponseWriter(rw http.ResponseWriter, capture bool) *trackingResponseWriter {
+	return &trackingResponseWriter{
+		rw:      rw,
+		header:  make(http.Header),
+		capture: capture,
+	}
+}
+
+func (tw *trackingResponseWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *trackingResponseWriter) WriteHeader(statusCode int) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	tw.writeHeaderLocked(statusCode)
+}
+
+func (tw *trackingResponseWriter) writeHeaderLocked(statusCode int) {
+	if tw.detached || tw.wroteHeader {
+		return
+	}
+	header := tw.rw.Header()
+	for k, v := range tw.header {
+		header[k] = v
+	}
+	tw.status = statusCode
+	tw.wroteHeader = true
+	tw.rw.WriteHeader(statusCode)
+}
+
+func (tw *trackingResponseWriter) Write(p []byte) (int, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.detached {
+		return 0, ErrResponseDetached
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	if tw.capture && !tw.truncated {
+		if tw.body.Len()+len(p) > maxCaptureSize {
+			tw.truncated = true
+			tw.body.Reset()
+		} else {
+			tw.body.Write(p)
+		}
+	}
+	return tw.rw.Write(p)
+}
+
+//反向代理在流式响应时会调用Flush
+func (tw *trackingResponseWriter) Flush() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.detached {
+		return
+	}
+	if flusher, ok := tw.rw.(http.Flusher); ok {
+		tw.writeHeaderLocked(http.StatusOK)
+		flusher.Flush()
+	}
+}
+
+//代理在写完响应体后才把trailer设置到Header中，写入响应头之后的修改需要在代理结束时复制到底层ResponseWriter
+//包括响应头Trailer中声明的字段和带http.TrailerPrefix前缀的字段；响应已被接管时丢弃
+func (tw *trackingResponseWriter) writeTrailers() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.detached || !tw.wroteHeader {
+		return
+	}
+	header := tw.rw.Header()
+	for _, names := range tw.header["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := tw.header[name]; ok {
+				header[name] = values
+			}
+		}
+	}
+	for name, values := range tw.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			header[name] = values
+		}
+	}
+}
+
+//接管响应，之后代理的写入全部丢弃；响应头尚未发送时返回true，调用方可以写入降级响应
+func (tw *trackingResponseWriter) detach() bool {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	tw.detached = true
+	return !tw.wroteHeader
+}
+
+//返回已发送的完整响应，用于缓存；响应未发送、内容超过上限或不能共享给其他用户时ok为false
+//返回的响应头不包含Set-Cookie
+func (tw *trackingResponseWriter) captured() (status int, header http.Header, body []byte, ok bool) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if !tw.capture || !tw.wroteHeader || tw.truncated || !shareableResponse(tw.header) {
+		return 0, nil, nil, false
+	}
+	header = tw.header.Clone()
+	header.Del("Set-Cookie")
+	return tw.status, header, append([]byte(nil), tw.body.Bytes()...), true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrackingResponseWriterDetach(t *testing.T) {
+	tests := []struct {
+		name string
+		//接管前代理写入的内容，为空时不写入
+		before string
+		//接管后能否写入降级响应
+		detached bool
+		body     string
+	}{
+		{"detach before the proxy writes", "", true, "fallback"},
+		{"detach after the proxy wrote", "partial", false, "partial"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		tw := newTrackingResponseWriter(rec, false)
+		tw.Header().Set("X-Upstream", "1")
+		if test.before != "" {
+			tw.Write([]byte(test.before))
+		}
+		if got := tw.detach(); got != test.detached {
+			t.Errorf("%s: detach() = %v, want %v", test.name, got, test.detached)
+		}
+		if test.detached {
+			rec.Header().Set("Content-Type", "text/plain")
+			rec.WriteHeader(http.StatusServiceUnavailable)
+			rec.Write([]byte("fallback"))
+		}
+
+		//接管后代理的写入全部丢弃
+		tw.WriteHeader(http.StatusBadGateway)
+		tw.Flush()
+		if n, err := tw.Write([]byte("late")); n != 0 || err != ErrResponseDetached {
+			t.Errorf("%s: late write returned %d, %v", test.name, n, err)
+		}
+		tw.writeTrailers()
+		if rec.Body.String() != test.body {
+			t.Errorf("%s: body %q, want %q", test.name, rec.Body.String(), test.body)
+		}
+		if got := rec.Header().Get("X-Upstream") != ""; got == test.detached {
+			t.Errorf("%s: upstream header copied = %v", test.name, got)
+		}
+	}
+}
+
+func TestTrackingResponseWriterTrailers(t *testing.T) {
+	rec := httptest.NewRecorder()
+	tw := newTrackingResponseWriter(rec, false)
+	tw.Header().Set("Trailer", "X-Checksum, X-Missing")
+	tw.WriteHeader(http.StatusOK)
+	tw.Write([]byte("body"))
+	//代理在写完响应体后设置trailer
+	tw.Header().Set("X-Checksum", "abc")
+	tw.Header().Set(http.TrailerPrefix+"X-Undeclared", "def")
+	tw.Header().Set("X-Late-Header", "ignored")
+	tw.writeTrailers()
+
+	result := rec.Result()
+	if got := result.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer X-Checksum = %q, want abc", got)
+	}
+	if got := rec.Header().Get(http.TrailerPrefix + "X-Undeclared"); got != "def" {
+		t.Errorf("trailer X-Undeclared = %q, want def", got)
+	}
+	if _, ok := rec.Header()["X-Missing"]; ok {
+		t.Error("declared trailer that was never set was copied")
+	}
+	if got := rec.Header().Get("X-Late-Header"); got != "" {
+		t.Errorf("header set after the response was written was copied: %q", got)
+	}
+}
+
+func TestTrackingResponseWriterCaptured(t *testing.T) {
+	tests := []struct {
+		name    string
+		capture bool
+		header  http.Header
+		body    string
+		ok      bool
+	}{
+		{"captured", true, http.Header{"Content-Type": {"text/plain"}}, "ok", true},
+		{"capture disabled", false, nil, "ok", false},
+		{"not shareable", true, http.Header{"Cache-Control": {"private"}}, "ok", false},
+		{"too large", true, nil, string(make([]byte, maxCaptureSize+1)), false},
+	}
+	for _, test := range tests {
+		tw := newTrackingResponseWriter(httptest.NewRecorder(), test.capture)
+		for k, v := range test.header {
+			tw.Header()[k] = v
+		}
+		tw.Write([]byte(test.body))
+		status, header, body, ok := tw.captured()
+		if ok != test.ok {
+			t.Errorf("%s: captured ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && (status != http.StatusOK || string(body) != test.body || header.Get("Content-Type") != "text/plain") {
+			t.Errorf("%s: captured %d %v %q", test.name, status, header, body)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"Hystrix/common/discover"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrRouteService = errors.New("route service is required")
+	ErrRoutePrefix  = errors.New("route path prefix must start with '/'")
+	//路由名称作为hystrix命令名称和按路由的配置key，不能重复
+	ErrRouteDuplicate = errors.New("duplicate route name")
+)
+
+//路由规则：根据host、method和路径前缀将请求映射到目标服务
+type Route struct {
+	//路由名称，为空时使用目标服务名，路由表中不能重复
+	Name string `json:"name" yaml:"name"`
+	//匹配的host，为空时匹配所有host
+	Host string `json:"host" yaml:"host"`
+	//匹配的路径前缀，按路径段匹配，例如 /api/v1/strings 不会匹配 /api/v1/stringsx
+	PathPrefix string `json:"path_prefix" yaml:"path_prefix"`
+	//匹配的请求方法，为空时匹配所有方法
+	Methods []string `json:"methods" yaml:"methods"`
+	//目标服务名，即注册中心中的服务名称，可以带查询参数按标签、元数据和健康状态筛选实例，
+	//例如 string?version=v2，见discover.ServiceQuery
+	Service string `json:"service" yaml:"service"`
+	//转发前是否去掉匹配的路径前缀
+	StripPrefix bool `json:"strip_prefix" yaml:"strip_prefix"`
+	//转发前将匹配的路径前缀替换为该值，优先于StripPrefix
+	RewritePrefix string `json:"rewrite_prefix" yaml:"rewrite_prefix"`
+	//该路由的hystrix参数，hystrix命令以路由名称命名
+	Hystrix *HystrixConfig `json:"hystrix" yaml:"hystrix"`
+	//该路由作为hystrix失败上报的上游响应状态码，为空时使用全局配置
+	FailureStatus []string `json:"failure_status" yaml:"failure_status"`
+	//hystrix执行失败时的降级配置，为空时返回默认错误
+	Fallback *FallbackConfig `json:"fallback" yaml:"fallback"`
+	//一致性哈希负载均衡使用的key：header:<name>、cookie:<name>、query:<name> 或 ip
+	HashKey string `json:"hash_key" yaml:"hash_key"`
+}
+
+//校验并规范化路由规则
+func (r *Route) normalize() error {
+	if r.Service == "" {
+		return ErrRouteService
+	}
+	if _, err := discover.ParseServiceQuery(r.Service); err != nil {
+		return fmt.Errorf("route service %q: %v", r.Service, err)
+	}
+	if r.PathPrefix == "" {
+		r.PathPrefix = "/"
+	}
+	if !strings.HasPrefix(r.PathPrefix, "/") {
+		return ErrRoutePrefix
+	}
+	if r.Name == "" {
+		r.Name = r.Service
+	}
+	if r.Fallback != nil {
+		if err := r.Fallback.validate(); err != nil {
+			return err
+		}
+	}
+	if r.HashKey != "" {
+		source := strings.SplitN(r.HashKey, ":", 2)[0]
+		switch {
+		case r.HashKey == "ip":
+		case (source == "header" || source == "cookie" || source == "query") && len(r.HashKey) > len(source)+1:
+		default:
+			return fmt.Errorf("invalid hash key %q", r.HashKey)
+		}
+	}
+	r.Host = strings.ToLower(r.Host)
+	for i, method := range r.Methods {
+		r.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+//判断请求是否命中该路由
+func (r *Route) match(host, method, path string) bool {
+	if r.Host != "" && r.Host != host {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return hasPathPrefix(path, r.PathPrefix)
+}
+
+//计算转发到目标服务的请求路径
+func (r *Route) RewritePath(path string) string {
+	if r.RewritePrefix == "" && !r.StripPrefix {
+		return path
+	}
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(r.PathPrefix, "/"))
+	prefix := strings.TrimSuffix(r.RewritePrefix, "/")
+	destPath := prefix + rest
+	if !strings.HasPrefix(destPath, "/") {
+		destPath = "/" + destPath
+	}
+	return destPath
+}
+
+//从请求中提取一致性哈希使用的key，未配置或请求中没有时返回空
+func (r *Route) hashKey(req *http.Request) string {
+	if r.HashKey == "" {
+		return ""
+	}
+	if r.HashKey == "ip" {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	}
+	parts := strings.SplitN(r.HashKey, ":", 2)
+	switch parts[0] {
+	case "header":
+		return req.Header.Get(parts[1])
+	case "cookie":
+		if cookie, err := req.Cookie(parts[1]); err == nil {
+			return cookie.Value
+		}
+	case "query":
+		return req.URL.Query().Get(parts[1])
+	}
+	return ""
+}
+
+//按路径段判断前缀
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+//路由表，匹配时最长前缀优先，前缀相同时按配置顺序
+type RouteTable struct {
+	routes []*Route
+}
+
+func NewRouteTable(routes []*Route) (*RouteTable, error) {
+	table := &RouteTable{routes: make([]*Route, 0, len(routes))}
+	names := make(map[string]bool, len(routes))
+	for i, route := range routes {
+		if route == nil {
+			continue
+		}
+		if err := route.normalize(); err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+		if names[route.Name] {
+			return nil, fmt.Errorf("route %d: %w %q", i, ErrRouteDuplicate, route.Name)
+		}
+		names[route.Name] = true
+		table.routes = append(table.routes, route)
+	}
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		return len(table.routes[i].PathPrefix) > len(table.routes[j].PathPrefix)
+	})
+	return table, nil
+}
+
+//查找请求命中的路由
+//路由表为空时兼容原有行为：把路径的第一段作为服务名并在转发时去掉
+func (rt *RouteTable) Match(req *http.Request) *Route {
+	if rt == nil || len(rt.routes) == 0 {
+		return legacyRoute(req.URL.Path)
+	}
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, route := range rt.routes {
+		if route.match(host, req.Method, req.URL.Path) {
+			return route
+		}
+	}
+	return nil
+}
+
+//根据路径第一段生成路由
+func legacyRoute(reqPath string) *Route {
+	pathArray := strings.Split(reqPath, "/")
+	if len(pathArray) < 2 || pathArray[1] == "" {
+		return nil
+	}
+	serviceName := pathArray[1]
+	return &Route{
+		Name:        serviceName,
+		PathPrefix:  "/" + serviceName,
+		Service:     serviceName,
+		StripPrefix: true,
+	}
+}
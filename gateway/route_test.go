@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/anything", "/", true},
+		{"/api/v1/strings", "/api/v1/strings", true},
+		{"/api/v1/strings/op", "/api/v1/strings", true},
+		{"/api/v1/stringsx", "/api/v1/strings", false},
+		{"/api/v1", "/api/v1/strings", false},
+		{"/api/v1/strings/", "/api/v1/strings/", true},
+		{"/api/v1/strings", "/api/v1/strings/", false},
+		{"/api/v1/stringsx", "/api/v1/strings/", false},
+	}
+	for _, test := range tests {
+		if got := hasPathPrefix(test.path, test.prefix); got != test.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", test.path, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	table, err := NewRouteTable([]*Route{
+		{Name: "root", PathPrefix: "/", Service: "default"},
+		{Name: "strings", PathPrefix: "/api/strings", Service: "string"},
+		{Name: "strings-write", PathPrefix: "/api/strings", Methods: []string{"post", "put"}, Service: "string-writer"},
+		{Name: "strings-v2", PathPrefix: "/api/strings/v2", Service: "string?version=v2"},
+		{Name: "admin", Host: "Admin.Example.com", PathPrefix: "/api", Service: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, host, path string
+		want               string
+	}{
+		//最长前缀优先
+		{"GET", "example.com", "/api/strings/v2/op", "strings-v2"},
+		{"GET", "example.com", "/api/strings/op", "strings"},
+		//按路径段匹配
+		{"GET", "example.com", "/api/stringsx", "root"},
+		//前缀相同时按配置顺序，方法不匹配时继续查找
+		{"POST", "example.com", "/api/strings", "strings"},
+		//host不区分大小写，并忽略端口
+		{"GET", "admin.example.com:8080", "/api/users", "admin"},
+		{"GET", "example.com", "/api/users", "root"},
+		{"GET", "example.com", "/", "root"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://"+test.host+test.path, nil)
+		route := table.Match(req)
+		if route == nil {
+			t.Errorf("%s %s%s: no route, want %s", test.method, test.host, test.path, test.want)
+			continue
+		}
+		if route.Name != test.want {
+			t.Errorf("%s %s%s: matched %s, want %s", test.method, test.host, test.path, route.Name, test.want)
+		}
+	}
+}
+
+func TestRouteTableMatchMethods(t *testing.T) {
+	table, err := NewRouteTable([]*Route{
+		{Name: "strings-write", PathPrefix: "/api/strings", Methods: []string{"post"}, Service: "string-writer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route := table.Match(httptest.NewRequest("POST", "/api/strings", nil)); route == nil || route.Name != "strings-write" {
+		t.Errorf("POST matched %v, want strings-write", route)
+	}
+	if route := table.Match(httptest.NewRequest("GET", "/api/strings", nil)); route != nil {
+		t.Errorf("GET matched %s, want no route", route.Name)
+	}
+}
+
+func TestRouteTableLegacy(t *testing.T) {
+	table, err := NewRouteTable(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := table.Match(httptest.NewRequest("GET", "/string/op/Concat/a/b", nil))
+	if route == nil || route.Service != "string" || route.Name != "string" {
+		t.Fatalf("legacy route = %+v, want service string", route)
+	}
+	if path := route.RewritePath("/string/op/Concat/a/b"); path != "/op/Concat/a/b" {
+		t.Errorf("legacy rewrite = %q, want /op/Concat/a/b", path)
+	}
+	if route := table.Match(httptest.NewRequest("GET", "/", nil)); route != nil {
+		t.Errorf("legacy route for / = %+v, want nil", route)
+	}
+}
+
+func TestNewRouteTableRejectsInvalidRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		route *Route
+	}{
+		{"missing service", &Route{PathPrefix: "/api"}},
+		{"relative prefix", &Route{PathPrefix: "api", Service: "string"}},
+		{"bad service query", &Route{PathPrefix: "/api", Service: "string?health=sick"}},
+		{"bad hash key", &Route{PathPrefix: "/api", Service: "string", HashKey: "header:"}},
+		{"bad fallback", &Route{PathPrefix: "/api", Service: "string", Fallback: &FallbackConfig{Type: "retry"}}},
+	}
+	for _, test := range tests {
+		if _, err := NewRouteTable([]*Route{test.route}); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestNewRouteTableRejectsDuplicateNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []*Route
+	}{
+		{"same name", []*Route{
+			{Name: "strings", PathPrefix: "/v1", Service: "string"},
+			{Name: "strings", PathPrefix: "/v2", Service: "string-v2"},
+		}},
+		//未设置名称时使用服务名
+		{"same default name", []*Route{
+			{PathPrefix: "/v1", Service: "string"},
+			{PathPrefix: "/v2", Service: "string"},
+		}},
+		{"name equal to a default name", []*Route{
+			{PathPrefix: "/v1", Service: "string"},
+			{Name: "string", PathPrefix: "/v2", Service: "string-v2"},
+		}},
+	}
+	for _, test := range tests {
+		if _, err := NewRouteTable(test.routes); !errors.Is(err, ErrRouteDuplicate) {
+			t.Errorf("%s: error %v, want ErrRouteDuplicate", test.name, err)
+		}
+	}
+}
+
+func TestRouteRewritePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		path  string
+		want  string
+	}{
+		{"unchanged", Route{PathPrefix: "/api/strings"}, "/api/strings/op", "/api/strings/op"},
+		{"strip", Route{PathPrefix: "/api/strings", StripPrefix: true}, "/api/strings/op", "/op"},
+		{"strip whole path", Route{PathPrefix: "/api/strings", StripPrefix: true}, "/api/strings", "/"},
+		{"strip prefix with slash", Route{PathPrefix: "/api/strings/", StripPrefix: true}, "/api/strings/op", "/op"},
+		{"strip root", Route{PathPrefix: "/", StripPrefix: true}, "/op", "/op"},
+		{"rewrite", Route{PathPrefix: "/api/strings", RewritePrefix: "/v2"}, "/api/strings/op", "/v2/op"},
+		{"rewrite with slash", Route{PathPrefix: "/api/strings", RewritePrefix: "/v2/"}, "/api/strings/op", "/v2/op"},
+		{"rewrite without leading slash", Route{PathPrefix: "/api/strings", RewritePrefix: "v2"}, "/api/strings/op", "/v2/op"},
+		{"rewrite overrides strip", Route{PathPrefix: "/api/strings", RewritePrefix: "/v2", StripPrefix: true}, "/api/strings/op", "/v2/op"},
+	}
+	for _, test := range tests {
+		if got := test.route.RewritePath(test.path); got != test.want {
+			t.Errorf("%s: RewritePath(%q) = %q, want %q", test.name, test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//默认作为hystrix失败上报的上游响应状态码
+var DefaultFailureStatus = []string{"5xx", "429"}
+
+//上游服务返回了被判定为失败的状态码
+type UpstreamStatusError struct {
+	StatusCode int
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with status %d", e.StatusCode)
+}
+
+//状态码区间，包含两端
+type statusRange struct {
+	min, max int
+}
+
+//上游响应状态码分类器，命中的状态码作为hystrix失败上报
+type StatusClassifier []statusRange
+
+//解析状态码规则，支持单个状态码(429)、类别(5xx)和区间(500-504)
+func ParseStatusClassifier(rules []string) (StatusClassifier, error) {
+	classifier := make(StatusClassifier, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+		var r statusRange
+		var err error
+		switch {
+		case len(rule) == 3 && strings.HasSuffix(rule, "xx"):
+			var class int
+			class, err = strconv.Atoi(rule[:1])
+			r = statusRange{class * 100, class*100 + 99}
+		case strings.Contains(rule, "-"):
+			bounds := strings.SplitN(rule, "-", 2)
+			r.min, err = strconv.Atoi(bounds[0])
+			if err == nil {
+				r.max, err = strconv.Atoi(bounds[1])
+			}
+		default:
+			r.min, err = strconv.Atoi(rule)
+			r.max = r.min
+		}
+		if err != nil || r.min < 100 || r.max > 599 || r.min > r.max {
+			return nil, fmt.Errorf("invalid failure status %q", rule)
+		}
+		classifier = append(classifier, r)
+	}
+	return classifier, nil
+}
+
+//判断状态码是否应作为失败上报
+func (c StatusClassifier) IsFailure(statusCode int) bool {
+	for _, r := range c {
+		if statusCode >= r.min && statusCode <= r.max {
+			return true
+		}
+	}
+	return false
+}
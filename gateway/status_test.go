@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseStatusClassifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		failures []int
+		passes   []int
+	}{
+		{"defaults", DefaultFailureStatus, []int{500, 503, 599, 429}, []int{200, 404, 428, 430}},
+		{"class", []string{"4XX"}, []int{400, 499}, []int{399, 500}},
+		{"single", []string{" 503 "}, []int{503}, []int{502, 504}},
+		{"range", []string{"500-504"}, []int{500, 502, 504}, []int{499, 505}},
+		{"empty rules", []string{"", " "}, nil, []int{500}},
+		{"none", nil, nil, []int{500, 429}},
+	}
+	for _, test := range tests {
+		classifier, err := ParseStatusClassifier(test.rules)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for _, status := range test.failures {
+			if !classifier.IsFailure(status) {
+				t.Errorf("%s: %d is not a failure", test.name, status)
+			}
+		}
+		for _, status := range test.passes {
+			if classifier.IsFailure(status) {
+				t.Errorf("%s: %d is a failure", test.name, status)
+			}
+		}
+	}
+}
+
+func TestParseStatusClassifierRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []string{"abc", "axx", "9xx", "0xx", "600", "99", "504-500", "500-", "-500", "500-600", "5x"} {
+		if _, err := ParseStatusClassifier([]string{"5xx", rule}); err == nil {
+			t.Errorf("rule %q: no error", rule)
+		}
+	}
+}
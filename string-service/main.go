@@ -2,19 +2,20 @@ package main
 
 import (
 	"Hystrix/common/discover"
+	"Hystrix/common/health"
+	"Hystrix/common/lifecycle"
 	"Hystrix/string-service/config"
 	"Hystrix/string-service/endpoint"
 	"Hystrix/string-service/service"
 	"Hystrix/string-service/transport"
 	"context"
 	"flag"
-	"fmt"
 	uuid "github.com/satori/go.uuid"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -26,22 +27,63 @@ func main() {
 		consulPort  = flag.Int("consul.port", 8500, "consul port")
 		consulHost  = flag.String("consul.host", "127.0.0.1", "consul host")
 		serviceName = flag.String("service.name", "string", "service name")
+		serviceZone = flag.String("service.zone", "", "zone of the service, registered in meta for zone aware load balance")
+		serviceTags = flag.String("service.tags", "", "comma separated tags registered with the instance, e.g. primary,canary")
+		serviceMeta = flag.String("service.meta", "", "comma separated key=value metadata registered with the instance, e.g. version=v2")
+		regTimeout  = flag.Duration("register.timeout", 30*time.Second, "deadline for registering the service, retried with back-off until then")
+
+		//注册中心的健康检查
+		checkType       = flag.String("check.type", discover.CheckHTTP, "health check type: http, ttl (heartbeats sent by the service), tcp, grpc")
+		checkInterval   = flag.Duration("check.interval", discover.DefaultCheckInterval, "interval of http, tcp and grpc checks")
+		checkTimeout    = flag.Duration("check.timeout", 0, "timeout of a single check, 0 for the registry default")
+		checkTTL        = flag.Duration("check.ttl", discover.DefaultCheckTTL, "ttl of the ttl check, heartbeats are sent every ttl/3")
+		checkDeregister = flag.Duration("check.deregister-after", discover.DefaultCheckDeregisterAfter, "deregister the instance after the check has been critical for this long")
+		healthTimeout   = flag.Duration("health.timeout", health.DefaultTimeout, "timeout of each check behind /health/live and /health/ready")
+
+		//优雅退出
+		propagationDelay = flag.Duration("shutdown.propagation-delay", lifecycle.DefaultPropagationDelay, "time to keep serving after deregistering and failing readiness, before draining")
+		shutdownTimeout  = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "deadline for in-flight requests to finish on shutdown")
+
+		//服务发现后端
+		discoveryBackend  = flag.String("discovery", discover.BackendConsul, "discovery backend: consul, file, dns, registry")
+		discoveryFile     = flag.String("discovery.file", "", "yaml or json file listing service instances, used by -discovery=file")
+		discoveryInterval = flag.Duration("discovery.file-interval", 2*time.Second, "interval to check the discovery file for changes")
+		dnsResolver       = flag.String("discovery.dns-resolver", "", "dns server host:port used by -discovery=dns, default first nameserver in /etc/resolv.conf")
+		dnsDomain         = flag.String("discovery.dns-domain", "", "domain of the _service._tcp SRV records, e.g. service.consul")
+		dnsRefresh        = flag.Duration("discovery.dns-refresh", 0, "fixed interval to refresh SRV records, 0 to follow record TTL")
+		registryAddr      = flag.String("discovery.registry-addr", "127.0.0.1:8700", "address of the embedded registry used by -discovery=registry")
+		maxStaleness      = flag.Duration("discovery.max-staleness", 0, "max age of cached instances served while the discovery backend is unavailable, 0 for no limit")
 	)
 
 	flag.Parse()
 
 	ctx := context.Background()
-	errChan := make(chan error)
-	var discoveryClient discover.DiscoveryClient
-	discoveryClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	discoveryClient, err := discover.NewDiscoveryClientV2(discover.Options{
+		Backend:      *discoveryBackend,
+		MaxStaleness: *maxStaleness,
+		ConsulHost:   *consulHost,
+		ConsulPort:   *consulPort,
+		File:         *discoveryFile,
+		FileInterval: *discoveryInterval,
+		DNSResolver:  *dnsResolver,
+		DNSDomain:    *dnsDomain,
+		DNSRefresh:   *dnsRefresh,
+
+		RegistryAddress: *registryAddr,
+	}, config.Logger)
 
 	if err != nil {
-		config.Logger.Println("Get Consul Client failed")
+		config.Logger.Println("create discovery client failed:", err)
 		os.Exit(-1)
 
 	}
+	//健康检查，注册中心按就绪检查的结果判断实例状态
+	healthz := health.New(*healthTimeout)
+	//退出时依次注销、就绪检查失败、等待传播、等待处理中的请求完成
+	lc := lifecycle.New(*propagationDelay, *shutdownTimeout, healthz, config.Logger)
+
 	var svc service.Service
-	svc = service.StringService{}
+	svc = service.StringService{Health: healthz}
 	stringEndpoint := endpoint.MakeStringEndpoint(svc)
 
 	//创建健康检查的Endpoint
@@ -54,32 +96,78 @@ func main() {
 	}
 
 	//创建http.Handler
-	r := transport.MakeHttpHandler(ctx, endpts, config.KitLogger)
+	r := transport.MakeHttpHandler(ctx, endpts, healthz, config.KitLogger)
 
 	instanceId := *serviceName + "-" + uuid.NewV4().String()
 
+	//标签和元数据供调用方按版本等条件筛选实例，例如同时运行多个版本
+	var tags []string
+	if *serviceTags != "" {
+		tags = strings.Split(*serviceTags, ",")
+	}
+	meta := make(map[string]string)
+	if *serviceMeta != "" {
+		for _, pair := range strings.Split(*serviceMeta, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				config.Logger.Println("invalid service meta:", pair)
+				os.Exit(-1)
+			}
+			meta[kv[0]] = kv[1]
+		}
+	}
+	//可用区写入实例元数据，供调用方优先选取相同可用区的实例
+	if *serviceZone != "" {
+		meta["zone"] = *serviceZone
+	}
+
 	//http server
+	//退出时先取消仍在重试的注册并等待其结束，避免注销后实例又被注册上去
+	registerCtx, cancelRegister := context.WithTimeout(ctx, *regTimeout)
+	registerDone := make(chan struct{})
 	go func() {
-
+		defer close(registerDone)
 		config.Logger.Println("Http Server start at port:" + strconv.Itoa(*servicePort))
-		//启动前执行注册
-		if !discoveryClient.Register(*serviceName, instanceId, "/health", *serviceHost, *servicePort, nil, config.Logger) {
-			config.Logger.Printf("string-service for service %s failed.", serviceName)
+		//启动前执行注册，失败时重试直到超时
+		err := discover.RegisterWithRetry(registerCtx, discoveryClient, &discover.Registration{
+			ServiceName:    *serviceName,
+			InstanceID:     instanceId,
+			Host:           *serviceHost,
+			Port:           *servicePort,
+			HealthCheckUrl: health.PathReady,
+			Tags:           tags,
+			Meta:           meta,
+			Check: &discover.Check{
+				Type:            *checkType,
+				Interval:        *checkInterval,
+				Timeout:         *checkTimeout,
+				TTL:             *checkTTL,
+				DeregisterAfter: *checkDeregister,
+				Status:          healthz.DiscoveryStatus,
+			},
+		}, time.Second, 10*time.Second, config.Logger)
+		//退出流程已取消注册
+		stopping := registerCtx.Err() == context.Canceled
+		cancelRegister()
+		if err != nil {
+			if stopping {
+				return
+			}
+			config.Logger.Printf("string-service for service %s failed: %v", *serviceName, err)
 			// 注册失败，服务启动失败
 			os.Exit(-1)
 		}
-		handler := r
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
-	}()
-
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
+		config.Logger.Println("register service success")
+		lc.Serve(&http.Server{Addr: ":" + strconv.Itoa(*servicePort), Handler: r})
 	}()
 
-	error := <-errChan
 	//服务退出取消注册
-	discoveryClient.Deregister(instanceId, config.Logger)
-	config.Logger.Println(error)
+	lc.OnDeregister(func(ctx context.Context) error {
+		cancelRegister()
+		<-registerDone
+		return discoveryClient.Deregister(ctx, instanceId)
+	})
+	//停止服务发现的后台查询和订阅
+	lc.OnStop(discoveryClient.Close)
+	config.Logger.Println(lc.Run())
 }
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"Hystrix/common/health"
+	"context"
 	"errors"
 	"strings"
 )
@@ -31,6 +33,8 @@ type Service interface {
 
 //ArithmeticService implement Service interface
 type StringService struct {
+	// Health readiness checks of the service, nil means always healthy
+	Health *health.Health
 }
 
 func (s StringService) Concat(a, b string) (string, error) {
@@ -63,9 +67,9 @@ func (s StringService) Diff(a, b string) (string, error) {
 }
 
 // HealthCheck implement Service method
-// 用于检查服务的健康状态，这里仅仅返回true。
+// 用于检查服务的健康状态，就绪检查为down时返回false。
 func (s StringService) HealthCheck() bool {
-	return true
+	return s.Health == nil || s.Health.Ready(context.Background()).Status != health.StatusDown
 }
 
 // ServiceMiddleware define service middleware
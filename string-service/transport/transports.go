@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"Hystrix/common/health"
 	"Hystrix/string-service/endpoint"
 	"context"
 	"encoding/json"
@@ -17,8 +18,8 @@ var (
 	ErrorBadRequest = errors.New("invalid request parameter")
 )
 
-// MakeHttpHandler make http handler use mux
-func MakeHttpHandler(ctx context.Context, endpoints endpoint.StringEndpoints, logger log.Logger) http.Handler {
+// MakeHttpHandler make http handler use mux, serve /health/live and /health/ready when healthz is not nil
+func MakeHttpHandler(ctx context.Context, endpoints endpoint.StringEndpoints, healthz *health.Health, logger log.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	options := []kithttp.ServerOption{
@@ -42,6 +43,10 @@ func MakeHttpHandler(ctx context.Context, endpoints endpoint.StringEndpoints, lo
 		encodeStringResponse,
 		options...,
 	))
+	if healthz != nil {
+		r.Methods("GET").Path(health.PathLive).Handler(healthz.LiveHandler())
+		r.Methods("GET").Path(health.PathReady).Handler(healthz.ReadyHandler())
+	}
 
 	return r
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"Hystrix/common/discover"
+	"Hystrix/common/health"
+	"Hystrix/common/lifecycle"
 	"Hystrix/common/loadbalance"
 	"Hystrix/use-string-service/config"
 	"Hystrix/use-string-service/endpoint"
@@ -9,14 +11,13 @@ import (
 	"Hystrix/use-string-service/transport"
 	"context"
 	"flag"
-	"fmt"
+	"github.com/afex/hystrix-go/hystrix"
 	"github.com/go-kit/kit/circuitbreaker"
 	uuid "github.com/satori/go.uuid"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"time"
 )
 
 //main完成服务注册并依次构建service层，endpoint层，transport层，
@@ -29,24 +30,99 @@ func main() {
 		serviceName = flag.String("service.name", "use-string", "service name")
 		consulPort  = flag.Int("consul.port", 8500, "consul port")
 		consulHost  = flag.String("consul.host", "127.0.0.1", "consul host")
+		lbStrategy  = flag.String("loadbalance", loadbalance.StrategyRandom, "load balance strategy: random, weight-round-robin, least-request, p2c-ewma, consistent-hash")
+		slowStart   = flag.Duration("slow-start", 0, "warm-up window for newly discovered string-service instances, 0 to disable")
+		zone        = flag.String("service.zone", "", "zone of the service, registered in meta and preferred when calling string-service")
+		zoneMin     = flag.Int("zone.min-capacity", 1, "minimum local zone capacity (sum of instance weights) before spilling over to other zones")
+		outlier     = flag.Bool("outlier", false, "eject instances with consecutive failures or high error rate from load balance")
+		outlierCF   = flag.Int("outlier.consecutive-failures", loadbalance.DefaultOutlierConfig.ConsecutiveFailures, "consecutive failures before an instance is ejected, 0 to disable")
+		outlierEP   = flag.Int("outlier.error-percent", loadbalance.DefaultOutlierConfig.ErrorPercent, "error percent within the interval before an instance is ejected, 0 to disable")
+		outlierBE   = flag.Duration("outlier.base-ejection", loadbalance.DefaultOutlierConfig.BaseEjectionTime, "base ejection time, doubled on each consecutive ejection")
+		outlierMEP  = flag.Int("outlier.max-ejection-percent", loadbalance.DefaultOutlierConfig.MaxEjectionPercent, "max percent of instances of a service that can be ejected")
+		stringQuery = flag.String("string-service.query", service.StringService, "string-service name with optional instance selectors, e.g. string?version=v2&tag=canary&health=passing,warning")
+		perInstance = flag.Bool("hystrix.per-instance", false, "maintain a circuit per string-service instance and skip instances whose circuit is open")
+		regTimeout  = flag.Duration("register.timeout", 30*time.Second, "deadline for registering the service, retried with back-off until then")
+
+		//注册中心的健康检查
+		checkType       = flag.String("check.type", discover.CheckHTTP, "health check type: http, ttl (heartbeats sent by the service), tcp, grpc")
+		checkInterval   = flag.Duration("check.interval", discover.DefaultCheckInterval, "interval of http, tcp and grpc checks")
+		checkTimeout    = flag.Duration("check.timeout", 0, "timeout of a single check, 0 for the registry default")
+		checkTTL        = flag.Duration("check.ttl", discover.DefaultCheckTTL, "ttl of the ttl check, heartbeats are sent every ttl/3")
+		checkDeregister = flag.Duration("check.deregister-after", discover.DefaultCheckDeregisterAfter, "deregister the instance after the check has been critical for this long")
+		healthTimeout   = flag.Duration("health.timeout", health.DefaultTimeout, "timeout of each check behind /health/live and /health/ready")
+
+		//优雅退出
+		propagationDelay = flag.Duration("shutdown.propagation-delay", lifecycle.DefaultPropagationDelay, "time to keep serving after deregistering and failing readiness, before draining")
+		shutdownTimeout  = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "deadline for in-flight requests to finish on shutdown")
+
+		//服务发现后端
+		discoveryBackend  = flag.String("discovery", discover.BackendConsul, "discovery backend: consul, file, dns, registry")
+		discoveryFile     = flag.String("discovery.file", "", "yaml or json file listing service instances, used by -discovery=file")
+		discoveryInterval = flag.Duration("discovery.file-interval", 2*time.Second, "interval to check the discovery file for changes")
+		dnsResolver       = flag.String("discovery.dns-resolver", "", "dns server host:port used by -discovery=dns, default first nameserver in /etc/resolv.conf")
+		dnsDomain         = flag.String("discovery.dns-domain", "", "domain of the _service._tcp SRV records, e.g. service.consul")
+		dnsRefresh        = flag.Duration("discovery.dns-refresh", 0, "fixed interval to refresh SRV records, 0 to follow record TTL")
+		registryAddr      = flag.String("discovery.registry-addr", "127.0.0.1:8700", "address of the embedded registry used by -discovery=registry")
+		maxStaleness      = flag.Duration("discovery.max-staleness", 0, "max age of cached instances served while the discovery backend is unavailable, 0 for no limit")
 	)
 
 	flag.Parse()
 
 	ctx := context.Background()
-	errChan := make(chan error)
 
 	//服务发现
-	var discoverClient discover.DiscoveryClient
-	discoverClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	discoverClient, err := discover.NewDiscoveryClientV2(discover.Options{
+		Backend:      *discoveryBackend,
+		MaxStaleness: *maxStaleness,
+		ConsulHost:   *consulHost,
+		ConsulPort:   *consulPort,
+		File:         *discoveryFile,
+		FileInterval: *discoveryInterval,
+		DNSResolver:  *dnsResolver,
+		DNSDomain:    *dnsDomain,
+		DNSRefresh:   *dnsRefresh,
+
+		RegistryAddress: *registryAddr,
+	}, config.Logger)
 	if err != nil {
-		config.Logger.Println("get consul client failed")
+		config.Logger.Println("create discovery client failed:", err)
 		os.Exit(-1)
 	}
 
+	//负载均衡
+	lb, err := loadbalance.NewLoadBalance(*lbStrategy)
+	if err != nil {
+		config.Logger.Println("create load balance failed:", err)
+		os.Exit(-1)
+	}
+	//新实例在预热窗口内逐步增加流量
+	if *slowStart > 0 {
+		lb = loadbalance.NewSlowStartLoadBalance(*slowStart, lb)
+	}
+	//优先调用相同可用区的string-service实例
+	var meta map[string]string
+	if *zone != "" {
+		lb = loadbalance.NewZoneAwareLoadBalance(*zone, *zoneMin, lb)
+		meta = map[string]string{loadbalance.DefaultZoneKey: *zone}
+	}
+	//摘除连续失败或错误率过高的实例
+	if *outlier {
+		outlierConfig := loadbalance.DefaultOutlierConfig
+		outlierConfig.ConsecutiveFailures = *outlierCF
+		outlierConfig.ErrorPercent = *outlierEP
+		outlierConfig.BaseEjectionTime = *outlierBE
+		outlierConfig.MaxEjectionPercent = *outlierMEP
+		lb = loadbalance.NewOutlierLoadBalance(outlierConfig, lb)
+	}
+
+	//健康检查，注册中心按就绪检查的结果判断实例状态
+	healthz := health.New(*healthTimeout)
+	//退出时依次注销、就绪检查失败、等待传播、等待处理中的请求完成
+	lc := lifecycle.New(*propagationDelay, *shutdownTimeout, healthz, config.Logger)
+
 	//【service层】
 	var svc service.Service
-	svc = service.NewUseStringService(discoverClient, &loadbalance.RandomLoadBalance{})
+	svc = service.NewUseStringService(discover.NewDiscoveryClientAdapter(discoverClient), lb, *stringQuery, *perInstance, healthz)
 
 	//【endpoint层】
 	useStringEndpoint := endpoint.MakeUseStringEndpoint(svc)
@@ -71,34 +147,61 @@ func main() {
 
 	//【transport层】
 	//创建http.handler
-	//r := transport.MakeHttpHandler(ctx, endpts, config.KitLogger)
-	r := transport.MakeHttpHandler(ctx, endptsWithKit, config.KitLogger)
+	//r := transport.MakeHttpHandler(ctx, endpts, healthz, lc.StreamHandler(hystrixStreamHandler), config.KitLogger)
+	//hystrix监控，开始退出时断开监控连接，请求处理完成后停止采集
+	hystrixStreamHandler := hystrix.NewStreamHandler()
+	hystrixStreamHandler.Start()
+	lc.OnStop(hystrixStreamHandler.Stop)
+	r := transport.MakeHttpHandler(ctx, endptsWithKit, healthz, lc.StreamHandler(hystrixStreamHandler), config.KitLogger)
 
 	instanceID := *serviceName + "-" + uuid.NewV4().String()
 
 	//http server
+	//退出时先取消仍在重试的注册并等待其结束，避免注销后实例又被注册上去
+	registerCtx, cancelRegister := context.WithTimeout(ctx, *regTimeout)
+	registerDone := make(chan struct{})
 	go func() {
+		defer close(registerDone)
 		config.Logger.Println("http server start at port:" + strconv.Itoa(*servicePort))
-		//启动前执行注册
-		if !discoverClient.Register(*serviceName, instanceID, "/health", *serviceHost, *servicePort, nil, config.Logger) {
+		//启动前执行注册，失败时重试直到超时
+		err := discover.RegisterWithRetry(registerCtx, discoverClient, &discover.Registration{
+			ServiceName:    *serviceName,
+			InstanceID:     instanceID,
+			Host:           *serviceHost,
+			Port:           *servicePort,
+			HealthCheckUrl: health.PathReady,
+			Meta:           meta,
+			Check: &discover.Check{
+				Type:            *checkType,
+				Interval:        *checkInterval,
+				Timeout:         *checkTimeout,
+				TTL:             *checkTTL,
+				DeregisterAfter: *checkDeregister,
+				Status:          healthz.DiscoveryStatus,
+			},
+		}, time.Second, 10*time.Second, config.Logger)
+		//退出流程已取消注册
+		stopping := registerCtx.Err() == context.Canceled
+		cancelRegister()
+		if err != nil {
+			if stopping {
+				return
+			}
 			//注册失败
-			config.Logger.Println("use-string-service for service %s failed", serviceName)
+			config.Logger.Printf("use-string-service for service %s failed: %v", *serviceName, err)
 			os.Exit(-1)
 		}
-		handler := r
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
-	}()
-
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errChan <- fmt.Errorf("%s", <-c)
+		config.Logger.Println("register service success")
+		lc.Serve(&http.Server{Addr: ":" + strconv.Itoa(*servicePort), Handler: r})
 	}()
 
-	error := <-errChan
-
-	//服务退出注销服务
-	discoverClient.Deregister(instanceID, config.Logger)
-	config.Logger.Println(error)
-
+	//服务退出取消注册
+	lc.OnDeregister(func(ctx context.Context) error {
+		cancelRegister()
+		<-registerDone
+		return discoverClient.Deregister(ctx, instanceID)
+	})
+	//停止服务发现的后台查询和订阅
+	lc.OnStop(discoverClient.Close)
+	config.Logger.Println(lc.Run())
 }
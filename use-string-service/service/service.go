@@ -1,16 +1,19 @@
 package service
 
 import (
+	"Hystrix/common/circuit"
 	"Hystrix/common/discover"
+	"Hystrix/common/health"
 	"Hystrix/common/loadbalance"
 	"Hystrix/use-string-service/config"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/afex/hystrix-go/hystrix"
-	"github.com/hashicorp/consul/api"
 	"net/http"
 	"net/url"
-	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,7 +21,10 @@ const (
 	StringService            = "string" //服务名
 )
 
-var ErrHystrixFallbackExecute = errors.New("hystrix fall back execute")
+var (
+	ErrHystrixFallbackExecute = errors.New("hystrix fall back execute")
+	ErrNoStringInstances      = errors.New("no string-service instances discovered")
+)
 
 type Service interface {
 
@@ -32,27 +38,89 @@ type Service interface {
 type UseStringService struct {
 	//服务发现客户端
 	discoverClient discover.DiscoveryClient
-	loadbalance    loadbalance.LoadBalance
+	//调用的string服务，可以带查询参数筛选实例，例如 string?version=v2
+	stringService string
+	loadbalance   loadbalance.LoadBalance
+	//实例级别断路器，为nil时整个服务使用一个断路器
+	breakers *circuit.InstanceBreakers
+	//已配置的实例级别hystrix命令
+	instanceCommands *sync.Map
+	//就绪检查，为nil时HealthCheck始终返回true
+	health *health.Health
 }
 
-func NewUseStringService(client discover.DiscoveryClient, lb loadbalance.LoadBalance) Service {
-
-	hystrix.ConfigureCommand(StringServiceCommandName, hystrix.CommandConfig{
-		/**
-		Timeout:                time.Duration(timeout) * time.Millisecond, 超时
-		MaxConcurrentRequests:  max, 最大并发请求数
-		RequestVolumeThreshold: uint64(volume), 最低请求阀值
-		SleepWindow:            time.Duration(sleep) * time.Millisecond, 时间窗口
-		ErrorPercentThreshold:  errorPercent 一旦错误的滚动度量超出请求的百分比，断路器就会打开
-		*/
-		//设置触发阀值
-		RequestVolumeThreshold: 5,
-	})
+var stringServiceCommandConfig = hystrix.CommandConfig{
+	/**
+	Timeout:                time.Duration(timeout) * time.Millisecond, 超时
+	MaxConcurrentRequests:  max, 最大并发请求数
+	RequestVolumeThreshold: uint64(volume), 最低请求阀值
+	SleepWindow:            time.Duration(sleep) * time.Millisecond, 时间窗口
+	ErrorPercentThreshold:  errorPercent 一旦错误的滚动度量超出请求的百分比，断路器就会打开
+	*/
+	//设置触发阀值
+	RequestVolumeThreshold: 5,
+}
 
-	return &UseStringService{
+//stringService为空时使用StringService，可以带查询参数，见discover.ServiceQuery
+//perInstance为true时按 命令名/实例ID 为每个实例维护断路器，负载均衡时跳过断路器打开的实例
+//healthz不为nil时注册string服务的断路器和实例检查，二者失败时服务状态为degraded
+func NewUseStringService(client discover.DiscoveryClient, lb loadbalance.LoadBalance, stringService string, perInstance bool, healthz *health.Health) Service {
+
+	hystrix.ConfigureCommand(StringServiceCommandName, stringServiceCommandConfig)
+
+	if stringService == "" {
+		stringService = StringService
+	}
+	service := &UseStringService{
 		discoverClient: client,
+		stringService:  stringService,
 		loadbalance:    lb,
+		health:         healthz,
+	}
+	//string服务的实例变化时重建负载均衡器
+	loadbalance.RebuildOnChange(client, lb, stringService)
+	if perInstance {
+		service.breakers = circuit.NewInstanceBreakers()
+		service.instanceCommands = &sync.Map{}
+	}
+	if healthz != nil {
+		healthz.AddReadiness("circuit:"+StringServiceCommandName, health.CheckerFunc(service.checkCircuit), false)
+		healthz.AddReadiness("discovery:"+stringService, health.CheckerFunc(service.checkInstances), false)
+	}
+	return service
+}
+
+//服务级断路器打开，或者每个实例一个断路器时所有实例的断路器都打开
+func (s UseStringService) checkCircuit(ctx context.Context) error {
+	if s.breakers == nil {
+		if cb, _, err := hystrix.GetCircuit(StringServiceCommandName); err == nil && cb.IsOpen() {
+			return hystrix.ErrCircuitOpen
+		}
+		return nil
 	}
+	instances := s.instances()
+	if len(instances) == 0 {
+		return nil
+	}
+	for _, instance := range instances {
+		//未调用过的实例还没有断路器
+		commandName := circuit.InstanceCommandName(StringServiceCommandName, instance.ID)
+		if _, ok := s.instanceCommands.Load(commandName); !ok {
+			return nil
+		}
+		if cb, _, err := hystrix.GetCircuit(commandName); err != nil || !cb.IsOpen() {
+			return nil
+		}
+	}
+	return hystrix.ErrCircuitOpen
+}
+
+//没有可用的string服务实例
+func (s UseStringService) checkInstances(ctx context.Context) error {
+	if len(s.instances()) == 0 {
+		return ErrNoStringInstances
+	}
+	return nil
 }
 
 type StringResponse struct {
@@ -64,100 +132,119 @@ type StringResponse struct {
 //对于每一个hystrix命令我们都需要为他们赋予不同的名称，表明了他们属于不同的远程调用
 //相同名称的命令会使用相同的熔断器进行熔断保护
 func (s UseStringService) UseStringService(oprationType, a, b string) (result string, err error) {
+	if s.breakers != nil {
+		return s.useStringServicePerInstance(oprationType, a, b)
+	}
 	//hystrix是一种同步调用方式
 	hystrix.Do(StringServiceCommandName, func() error {
-		//注意：获取服务名为string的服务列表
-		instances := s.discoverClient.DiscoverServices(StringService, config.Logger)
-		instancesList := make([]*api.AgentService, len(instances))
-		for i := 0; i < len(instances); i++ {
-			instancesList[i] = instances[i].(*api.AgentService)
-		}
-
 		//使用负载均衡算法获取实例
-		selectedInstance, err := s.loadbalance.SelectService(instancesList)
+		selectedInstance, done, err := loadbalance.Select(s.loadbalance, s.stringService, s.instances())
 		if err == nil {
-			//成功获取
-			config.Logger.Printf("current string-service ID is %s and address:port is %s:%s\n",
-				selectedInstance.ID, selectedInstance.Address, strconv.Itoa(selectedInstance.Port))
-			requestUrl := url.URL{
-				Scheme: "http",
-				Host:   selectedInstance.Address + ":" + strconv.Itoa(selectedInstance.Port),
-				Path:   "/op/" + oprationType + "/" + a + "/" + b,
-			}
-			resp, err := http.Post(requestUrl.String(), "", nil)
-			if err == nil {
-				res := &StringResponse{}
-				/*
-					区别
-					1、json.NewDecoder是从一个流里面直接进行解码，代码精干
-					2、json.Unmarshal是从已存在与内存中的json进行解码
-					3、相对于解码，json.NewEncoder进行大JSON的编码比json.marshal性能高，因为内部使用pool
-
-					场景应用
-					1、json.NewDecoder用于http连接与socket连接的读取与写入，或者文件读取
-					2、json.Unmarshal用于直接是byte的输入
-				*/
-				err = json.NewDecoder(resp.Body).Decode(result)
-				if err == nil && res.Error == nil {
-					result = res.Result
-				}
-			}
+			start := time.Now()
+			result, err = callStringService(selectedInstance, oprationType, a, b)
+			//将调用结果和耗时反馈给负载均衡器
+			done(loadbalance.DoneInfo{Err: err, Duration: time.Since(start)})
 		}
 		return err
-	}, func(err error) error {
-		//服务调用失败时进行异常处理和回滚操作
-		return ErrHystrixFallbackExecute
-	})
+	}, fallback)
 
 	return result, err
 
 }
 
+//每个实例使用独立的hystrix命令，跳过断路器打开的实例，所有实例的断路器都打开时才执行降级
+func (s UseStringService) useStringServicePerInstance(oprationType, a, b string) (result string, err error) {
+	instancesList := s.breakers.Available(StringServiceCommandName, s.instances())
+	selectedInstance, done, err := loadbalance.Select(s.loadbalance, s.stringService, instancesList)
+	if err != nil {
+		fallback(err)
+		return result, nil
+	}
+	commandName := circuit.InstanceCommandName(StringServiceCommandName, selectedInstance.ID)
+	if _, ok := s.instanceCommands.Load(commandName); !ok {
+		hystrix.ConfigureCommand(commandName, stringServiceCommandConfig)
+		s.instanceCommands.Store(commandName, true)
+	}
+	//hystrix拒绝执行时run不会被调用，保证负载均衡器的反馈只执行一次
+	var once sync.Once
+	finish := func(info loadbalance.DoneInfo) {
+		once.Do(func() {
+			done(info)
+		})
+	}
+	hystrix.Do(commandName, func() error {
+		start := time.Now()
+		var err error
+		result, err = callStringService(selectedInstance, oprationType, a, b)
+		finish(loadbalance.DoneInfo{Err: err, Duration: time.Since(start)})
+		return err
+	}, func(err error) error {
+		finish(loadbalance.DoneInfo{Err: err})
+		return fallback(err)
+	})
+	return result, nil
+}
+
+//服务调用失败时进行异常处理和回滚操作
+func fallback(err error) error {
+	return ErrHystrixFallbackExecute
+}
+
 //使用kit的hystrix
 func (s UseStringService) UseStringServiceWithKit(oprationType, a, b string) (result string, err error) {
 
-	//注意：获取服务名为string的服务列表
-	instances := s.discoverClient.DiscoverServices(StringService, config.Logger)
-	instancesList := make([]*api.AgentService, len(instances))
-	for i := 0; i < len(instances); i++ {
-		instancesList[i] = instances[i].(*api.AgentService)
-	}
-
 	//使用负载均衡算法获取实例
-	selectedInstance, err := s.loadbalance.SelectService(instancesList)
+	selectedInstance, done, err := loadbalance.Select(s.loadbalance, s.stringService, s.instances())
 	if err == nil {
-		//成功获取
-		config.Logger.Printf("current string-service ID is %s and address:port is %s:%s\n",
-			selectedInstance.ID, selectedInstance.Address, strconv.Itoa(selectedInstance.Port))
-		requestUrl := url.URL{
-			Scheme: "http",
-			Host:   selectedInstance.Address + ":" + strconv.Itoa(selectedInstance.Port),
-			Path:   "/op/" + oprationType + "/" + a + "/" + b,
-		}
-		resp, err := http.Post(requestUrl.String(), "", nil)
-		if err == nil {
-			res := &StringResponse{}
-			/*
-				区别
-				1、json.NewDecoder是从一个流里面直接进行解码，代码精干
-				2、json.Unmarshal是从已存在与内存中的json进行解码
-				3、相对于解码，json.NewEncoder进行大JSON的编码比json.marshal性能高，因为内部使用pool
-
-				场景应用
-				1、json.NewDecoder用于http连接与socket连接的读取与写入，或者文件读取
-				2、json.Unmarshal用于直接是byte的输入
-			*/
-			err = json.NewDecoder(resp.Body).Decode(result)
-			if err == nil && res.Error == nil {
-				result = res.Result
-			}
-		}
+		start := time.Now()
+		result, err = callStringService(selectedInstance, oprationType, a, b)
+		//将调用结果和耗时反馈给负载均衡器
+		done(loadbalance.DoneInfo{Err: err, Duration: time.Since(start)})
 	}
 	return result, err
 
 }
+
+//注意：获取服务名为string（按查询条件筛选）的服务列表
+func (s UseStringService) instances() []*discover.ServiceInstance {
+	return s.discoverClient.DiscoverServices(s.stringService, config.Logger)
+}
+
+//调用选取的string-service实例
+func callStringService(selectedInstance *discover.ServiceInstance, oprationType, a, b string) (result string, err error) {
+	config.Logger.Printf("current string-service ID is %s and address:port is %s\n",
+		selectedInstance.ID, selectedInstance.Address())
+	requestUrl := url.URL{
+		Scheme: "http",
+		Host:   selectedInstance.Address(),
+		Path:   "/op/" + oprationType + "/" + a + "/" + b,
+	}
+	resp, err := http.Post(requestUrl.String(), "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	res := &StringResponse{}
+	/*
+		区别
+		1、json.NewDecoder是从一个流里面直接进行解码，代码精干
+		2、json.Unmarshal是从已存在与内存中的json进行解码
+		3、相对于解码，json.NewEncoder进行大JSON的编码比json.marshal性能高，因为内部使用pool
+
+		场景应用
+		1、json.NewDecoder用于http连接与socket连接的读取与写入，或者文件读取
+		2、json.Unmarshal用于直接是byte的输入
+	*/
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err == nil && res.Error == nil {
+		result = res.Result
+	}
+	return result, err
+}
+
+//就绪检查为down时返回false，依赖不可用（degraded）时仍可返回降级结果
 func (s UseStringService) HealthCheck() bool {
-	return true
+	return s.health == nil || s.health.Ready(context.Background()).Status != health.StatusDown
 }
 
 //装饰者模式
@@ -1,11 +1,11 @@
 package transport
 
 import (
+	"Hystrix/common/health"
 	"Hystrix/use-string-service/endpoint"
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/afex/hystrix-go/hystrix"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
@@ -21,8 +21,9 @@ var (
 	ErrorBadRequest = errors.New("invalid request paramter")
 )
 
-//使用mux创建路由
-func MakeHttpHandler(ctx context.Context, endpoint endpoint.UseStringEndpoint, logger log.Logger) http.Handler {
+//使用mux创建路由，healthz不为nil时提供/health/live和/health/ready
+//hystrixStreamHandler由调用方启动，退出时由调用方断开监控连接
+func MakeHttpHandler(ctx context.Context, endpoint endpoint.UseStringEndpoint, healthz *health.Health, hystrixStreamHandler http.Handler, logger log.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	options := []kithttp.ServerOption{
@@ -45,11 +46,13 @@ func MakeHttpHandler(ctx context.Context, endpoint endpoint.UseStringEndpoint, l
 		endcodeStringResponse,
 		options...,
 	))
+	if healthz != nil {
+		r.Methods("GET").Path(health.PathLive).Handler(healthz.LiveHandler())
+		r.Methods("GET").Path(health.PathReady).Handler(healthz.ReadyHandler())
+	}
 
 	//添加hystrix监控
 	//hystrixStreamHandler会把metrics控制器收集的所有状态信息按每秒1次的频率向所有连接的http客户端推送
-	hystrixStreamHandler := hystrix.NewStreamHandler()
-	hystrixStreamHandler.Start()
 	r.Handle("/hystrix/stream", hystrixStreamHandler)
 
 	return r